@@ -1,38 +1,150 @@
 package CLI
 
 import (
-	"go_code/A_golang_blockchain/base58"
+	"bytes"
+	"context"
 	"go_code/A_golang_blockchain/transaction"
 	"fmt"
 	"os"
 	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
 	"flag"
 	"go_code/A_golang_blockchain/blockchain"
-	"go_code/A_golang_blockchain/pow"
+	"go_code/A_golang_blockchain/consensus"
+	"go_code/A_golang_blockchain/chaincfg"
+	"go_code/A_golang_blockchain/config"
+	"path/filepath"
 	"go_code/A_golang_blockchain/wallet"
 	"go_code/A_golang_blockchain/utxo"
+	"go_code/A_golang_blockchain/mempool"
+	"go_code/A_golang_blockchain/miner"
+	"go_code/A_golang_blockchain/block"
+	"go_code/A_golang_blockchain/addrindex"
+	"go_code/A_golang_blockchain/ledger"
 	"strconv"
-	"log"
+	"strings"
+	"errors"
+	"runtime"
+	"os/signal"
+	"syscall"
+	"time"
+	"bufio"
+	"io"
 )
 //首先我们想要拥有这些命令 1.加入区块命令 2.打印区块链命令
 
 //创建一个CLI结构体
 type CLI struct {
 	//BC *blockchain.Blockchain
+	cfg *config.Config //节点配置，由parseGlobalFlags加载
 }
 
 
 //加入输入格式错误信息提示
 func (cli *CLI) printUsage() {
-	fmt.Println("Usage:")
+	fmt.Println("Usage: [-datadir DIR] [-config FILE] [-network mainnet|testnet|regtest] COMMAND")
+	fmt.Println("  -datadir 数据目录，默认为 ~/.a_golang_blockchain，不同网络的数据分别存放在其中的子目录中")
+	fmt.Println("  -config  配置文件(TOML)，默认为数据目录下的 config.toml")
+	fmt.Println("  -network 使用的网络，默认为mainnet")
+	fmt.Println("  配置项也可以通过环境变量设置，例如 BLOCKCHAIN_DATADIR、BLOCKCHAIN_NETWORK、BLOCKCHAIN_MINERADDRESS")
 	// fmt.Println("  getbalance -address ADDRESS  得到该地址的余额")
-	fmt.Println("  createblockchain -address ADDRESS 创建一条链并且该地址会得到狗头金")
-	fmt.Println(" createwallet - 创建一个钱包，里面放着一对秘钥")
-	fmt.Println(" getbalance -address ADDRESS  得到该地址的余额")
+	fmt.Println("  createblockchain -address ADDRESS [CONSENSUS] 创建一条链并且该地址会得到狗头金")
+	fmt.Println(" createwallet [-type p256|secp256k1|ed25519|schnorr] - 创建一个钱包，里面放着一对秘钥，默认为p256")
+	fmt.Println(" getbalance -address ADDRESS [-minconf N] 得到该地址的余额，分为已确认、未确认和未成熟的挖矿奖励")
 	fmt.Println("  listaddresses - Lists all addresses from the wallet file")
-	fmt.Println("  printchain - 打印链")
-	fmt.Println("  reindexutxo - Rebuilds the UTXO set")
-	fmt.Println("  send -from FROM -to TO -amount AMOUNT 地址from发送amount的币给地址to")
+	fmt.Println("  importaddress -address ADDRESS [-rescan=false] 导入只读地址，可以查询余额和交易记录，但是不能花费")
+	fmt.Println("  importpubkey -pubkey HEX [-rescan=false] 导入公钥作为只读地址")
+	fmt.Println("  importprivkey -key WIF [-address ADDRESS] [-rescan=false] 导入WIF格式的私钥，给出 -address 时检查私钥是否属于该地址")
+	fmt.Println("  dumpprivkey -address ADDRESS 打印该地址的WIF格式私钥")
+	fmt.Println("  dumpwallet -file FILE 把钱包中所有私钥导出到FILE，FILE不能已经存在")
+	fmt.Println("  importwallet -file FILE [-rescan=false] 导入dumpwallet导出的私钥")
+	fmt.Println("      默认导入后重新扫描区块，-rescan=false 时跳过")
+	fmt.Println("  printchain [CONSENSUS] - 打印链")
+	fmt.Println("  reindexutxo [-verify] - Rebuilds the UTXO set，-verify 时先用全部CPU核心重新验证链上所有交易的签名")
+	fmt.Println("  listtransactions -address ADDRESS [-count N] [-skip M] 列出该地址的交易记录，需要在配置中启用 addrindex")
+	fmt.Println("  rescanwallet [-from HEIGHT] 从高度HEIGHT开始重新扫描区块，重建钱包的交易记录")
+	fmt.Println("  listunspent - 列出钱包中未花费的输出")
+	fmt.Println("  gettransaction -txid TXID 显示钱包中的一笔交易")
+	fmt.Println("  createrawtransaction -from FROM -to TO -amount AMOUNT [-fee FEE] [-rbf] [-minconf N] [-json] 创建未签名的交易，不需要FROM的私钥")
+	fmt.Println("  signrawtransaction -tx TX [-sighash TYPE] [-json] 用钱包中的私钥签名交易，不需要区块链")
+	fmt.Println("      -sighash 签名覆盖的范围：ALL(默认)、NONE、SINGLE，可以加上 |ANYONECANPAY，例如 ALL|ANYONECANPAY")
+	fmt.Println("  sendrawtransaction -tx TX 把签名完成的交易放入交易池")
+	fmt.Println("      TX为十六进制或者JSON编码的交易，为 - 时从标准输入读取")
+	fmt.Println("  bumpfee -txid TXID [-fee FEE] 提高交易池中一笔 -rbf 交易的手续费，增加的部分从找零中扣除")
+	fmt.Println("      -fee 为新的手续费，默认为原来的两倍")
+	fmt.Println("  invalidateblock -hash HASH 把该区块及其之后的区块从链上断开并标记为无效")
+	fmt.Println("  reconsiderblock -hash HASH [CONSENSUS] 取消无效标记并重新连接被断开的区块")
+	fmt.Println("  send -from FROM -to TO -amount AMOUNT [-fee FEE] [-rbf] [-minconf N] [-mine=false] [CONSENSUS] 地址from发送amount的币给地址to")
+	fmt.Println("      -fee 支付给矿工的手续费，-rbf 允许交易确认之前被手续费更高的交易替换")
+	fmt.Println("      -mine=false 时交易只放入交易池，等待 mine 命令打包")
+	fmt.Println("      -minconf N 只花费至少N个确认的输出，默认为1；挖矿奖励要经过网络规定的区块数之后才能花费")
+	fmt.Println("      -minconf 0 -mine=false 时还可以花费交易池中支付给from的还没确认的输出，例如用手续费更高的子交易带动父交易(CPFP)")
+	fmt.Println("  mine -address ADDRESS [-blocks N] [-interval DURATION] [-stdin] [CONSENSUS] 挖矿，奖励发给address")
+	fmt.Println("      -blocks 为0时一直挖下去，按Ctrl+C退出，-address 默认为配置中的 mineraddress")
+	fmt.Println("      mine 运行期间独占数据库，其他命令无法打开数据库，交易要通过挖矿进程提交：")
+	fmt.Println("      -stdin 从标准输入逐行读取签名完成的交易(格式同 sendrawtransaction)放入交易池，新交易会让矿工重新生成区块模板")
+	fmt.Println("  CONSENSUS: [-consensus pow|poa|dev] [-threads N] [-authorities ADDR1,ADDR2] [-signer ADDRESS]")
+	fmt.Println("      pow 工作量证明，-threads 为挖矿使用的协程数，默认使用全部CPU核心")
+	fmt.Println("      poa 权威证明，区块由 -signer 签名，签名者必须在 -authorities 白名单中")
+	fmt.Println("      dev 开发模式，区块立即封装")
+	fmt.Println("      不指定 -consensus 时mainnet和testnet使用pow，regtest使用dev")
+}
+
+//共识引擎相关的命令行参数
+type consensusFlags struct {
+	walletFile  string
+	name        *string
+	threads     *int
+	authorities *string
+	signer      *string
+}
+
+//为需要封装或验证区块的命令注册共识引擎参数，默认值来自配置
+func (cli *CLI) addConsensusFlags(fs *flag.FlagSet) *consensusFlags {
+	threads := cli.cfg.Threads
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+	return &consensusFlags{
+		walletFile:  cli.walletFile(),
+		name:        fs.String("consensus", cli.cfg.Consensus, "Consensus engine: pow, poa or dev (default depends on -network)"),
+		threads:     fs.Int("threads", threads, "Number of mining threads (pow)"),
+		authorities: fs.String("authorities", strings.Join(cli.cfg.Authorities, ","), "Comma separated addresses allowed to sign blocks (poa)"),
+		signer:      fs.String("signer", cli.cfg.Signer, "Wallet address used to sign blocks (poa)"),
+	}
+}
+
+//根据命令行参数创建共识引擎
+func (f *consensusFlags) engine() (consensus.Engine, error) {
+	name := *f.name
+	if name == "" {
+		name = chaincfg.ActiveNetParams.Consensus
+	}
+	switch name {
+	case "pow":
+		return consensus.NewPoW(*f.threads), nil
+	case "poa":
+		if *f.authorities == "" {
+			return nil, errors.New("-authorities is required for poa")
+		}
+		var signer *wallet.Wallet
+		if *f.signer != "" {
+			wallets, err := wallet.NewWallets(f.walletFile)
+			if err != nil {
+				return nil, err
+			}
+			w, err := wallets.GetWallet(*f.signer)
+			if err != nil {
+				return nil, err
+			}
+			signer = &w
+		}
+		return consensus.NewPoA(strings.Split(*f.authorities, ","), signer)
+	case "dev":
+		return consensus.NewDev(), nil
+	}
+	return nil, fmt.Errorf("unknown consensus engine %s", name)
 }
 
 //判断命令行参数，如果没有输入参数则显示提示信息
@@ -43,6 +155,120 @@ func (cli *CLI) validateArgs() {
 	}
 }
 
+//解析全局参数，加载配置文件和环境变量，切换到对应的网络，返回命令及其参数
+func (cli *CLI) parseGlobalFlags() ([]string, error) {
+	globalFlags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	globalFlags.Usage = cli.printUsage
+	dataDir := globalFlags.String("datadir", "", "Data directory")
+	configFile := globalFlags.String("config", "", "Config file")
+	network := globalFlags.String("network", "", "Network to use: mainnet, testnet or regtest")
+	err := globalFlags.Parse(os.Args[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	//配置文件的位置取决于数据目录，数据目录本身也可能来自环境变量
+	required := *configFile != ""
+	path := *configFile
+	if path == "" {
+		path = os.Getenv(config.EnvPrefix + "CONFIG")
+		required = path != ""
+	}
+	if path == "" {
+		dir := *dataDir
+		if dir == "" {
+			dir = os.Getenv(config.EnvPrefix + "DATADIR")
+		}
+		if dir == "" {
+			dir = config.DefaultDataDir()
+		}
+		path = filepath.Join(dir, config.ConfigFile)
+	}
+	cfg, err := config.Load(path, required)
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.ApplyEnv()
+	if err != nil {
+		return nil, err
+	}
+	if *dataDir != "" {
+		cfg.DataDir = *dataDir
+	}
+	if *network != "" {
+		cfg.Network = *network
+	}
+	cli.cfg = cfg
+
+	err = chaincfg.SetActiveNet(cfg.Network)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(cfg.NetworkDir(), 0700)
+	if err != nil {
+		return nil, err
+	}
+	return globalFlags.Args(), nil
+}
+
+//当前网络的区块链数据库文件路径
+func (cli *CLI) dbFile() string {
+	return filepath.Join(cli.cfg.NetworkDir(), chaincfg.ActiveNetParams.DBFile)
+}
+
+//当前网络的钱包文件路径
+func (cli *CLI) walletFile() string {
+	return filepath.Join(cli.cfg.NetworkDir(), chaincfg.ActiveNetParams.WalletFile)
+}
+
+//当前网络的钱包交易记录文件路径
+func (cli *CLI) ledgerFile() string {
+	return filepath.Join(cli.cfg.NetworkDir(), chaincfg.ActiveNetParams.LedgerFile)
+}
+
+//加载钱包和交易记录，并扫描上次扫描之后加入链的区块
+func (cli *CLI) syncLedger(bc *blockchain.Blockchain) (*ledger.Ledger, func(pubKeyHash []byte) bool, error) {
+	wallets, err := wallet.NewWallets(cli.walletFile())
+	if err != nil {
+		return nil, nil, err
+	}
+	isMine := ledger.IsMineFunc(wallets)
+	l, err := ledger.NewLedger(cli.ledgerFile())
+	if err != nil {
+		return nil, nil, err
+	}
+	tip := l.BestBlock
+	err = l.Sync(bc, isMine)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(tip, l.BestBlock) {
+		err = l.SaveToFile(cli.ledgerFile())
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return l, isMine, nil
+}
+
+//打开当前网络的区块链，配置中启用了地址索引时先同步再注册地址索引
+func (cli *CLI) openBlockchain() (*blockchain.Blockchain, error) {
+	bc, err := blockchain.NewBlockchain(cli.dbFile())
+	if err != nil {
+		return nil, err
+	}
+	if cli.cfg.AddrIndex {
+		idx := addrindex.NewAddrIndex()
+		err = idx.Sync(bc)
+		if err != nil {
+			bc.Db().Close()
+			return nil, err
+		}
+		bc.AddIndexer(idx)
+	}
+	return bc, nil
+}
+
 // //加入区块函数调用
 // func (cli *CLI) addBlock(data string) {
 // 	cli.BC.MineBlock(data)
@@ -52,67 +278,221 @@ func (cli *CLI) validateArgs() {
 
 
 //创建一条链
-func (cli *CLI) createBlockchain(address string) {
+func (cli *CLI) createBlockchain(address string,engine consensus.Engine) error {
 	if !wallet.ValidateAddress(address) {
-		log.Panic("ERROR: Address is not valid")
+		return wallet.ErrInvalidAddress
 	}
 
-	bc := blockchain.CreateBlockchain(address)
+	bc,err := blockchain.CreateBlockchain(cli.dbFile(),address,engine)
+	if err != nil {
+		return err
+	}
 	defer bc.Db().Close()
 
-	UTXOSet := utxo.UTXOSet{bc}
-	UTXOSet.Reindex()
+	//创世区块的UTXO已经和区块一起写入，不需要再重建UTXO集
 	fmt.Println("Done!")
+	return nil
 }
 
 //创建钱包函数
-func (cli *CLI) createWallet() {
-	wallets, _ := wallet.NewWallets()
-	address := wallets.CreateWallet()
-	wallets.SaveToFile()
+func (cli *CLI) createWallet(keyType string) error {
+	t, err := wallet.ParseKeyType(keyType)
+	if err != nil {
+		return err
+	}
+	wallets, err := wallet.NewWallets(cli.walletFile())
+	if err != nil {
+		return err
+	}
+	address, err := wallets.CreateWalletOfType(t)
+	if err != nil {
+		return err
+	}
+	err = wallets.SaveToFile(cli.walletFile())
+	if err != nil {
+		return err
+	}
 	fmt.Printf("Your new address: %s\n", address)
+	return nil
 }
 
-//求账户余额
-func (cli *CLI) getBalance(address string) {
+//求账户余额，分为确认数不少于minConf的余额、未确认的余额(包括交易池中的交易)和未成熟的挖矿奖励
+func (cli *CLI) getBalance(address string,minConf int) error {
 	if !wallet.ValidateAddress(address) {
-		log.Panic("ERROR: Address is not valid")
+		return wallet.ErrInvalidAddress
+	}
+	bc,err := cli.openBlockchain()
+	if err != nil {
+		return err
 	}
-	bc := blockchain.NewBlockchain()
-	UTXOSet := utxo.UTXOSet{bc}
+	UTXOSet := utxo.UTXOSet{Blockchain: bc}
 	defer bc.Db().Close()
 
-	balance := 0
-	pubKeyHash := base58.Base58Decode([]byte(address))
-	pubKeyHash = pubKeyHash[1:len(pubKeyHash)-4] //这里的4是校验位字节数，这里就不在其他包调过来了
-	
-	UTXOs := UTXOSet.FindUTXO(pubKeyHash)
-
-	//遍历UTXOs中的交易输出out，得到输出字段out.Value,求出余额
-	for _,out := range UTXOs {
-		balance += out.Value
+	pubKeyHash := wallet.AddressPubKeyHash(address)
+	balance,err := UTXOSet.Balance(pubKeyHash,minConf)
+	if err != nil {
+		return err
 	}
+	pool := mempool.Mempool{Blockchain: bc}
+	pending,err := pool.UnconfirmedBalance(pubKeyHash)
+	if err != nil {
+		return err
+	}
+	balance.Unconfirmed += pending
 
-	fmt.Printf("Balance of '%s':%d\n",address,balance)
+	fmt.Printf("Balance of '%s':%d\n",address,balance.Confirmed)
+	fmt.Printf("  unconfirmed: %d\n",balance.Unconfirmed)
+	fmt.Printf("  immature: %d\n",balance.Immature)
+	return nil
 }
 
 //列出地址名单,钱包集合中的地址有哪些
-func (cli *CLI) listAddresses() {
-	wallets, err := wallet.NewWallets()
+func (cli *CLI) listAddresses() error {
+	wallets, err := wallet.NewWallets(cli.walletFile())
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 	addresses := wallets.GetAddresses()
 	for _, address := range addresses {
 		fmt.Println(address)
 	}
+	for _, address := range wallets.GetWatchOnlyAddresses() {
+		fmt.Printf("%s (watch-only)\n", address)
+	}
+	return nil
+}
+
+//导入只读地址，rescan为true时重新扫描区块，把该地址的交易加入钱包的交易记录
+func (cli *CLI) importAddress(address string, rescan bool) error {
+	wallets, err := wallet.NewWallets(cli.walletFile())
+	if err != nil {
+		return err
+	}
+	err = wallets.ImportAddress(address)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported watch-only address: %s\n", address)
+	return cli.saveImported(wallets, rescan)
+}
+
+//导入十六进制编码的公钥作为只读地址
+func (cli *CLI) importPubKey(pubKeyHex string, rescan bool) error {
+	pubKey, err := hex.DecodeString(pubKeyHex)
+	if err != nil {
+		return err
+	}
+	wallets, err := wallet.NewWallets(cli.walletFile())
+	if err != nil {
+		return err
+	}
+	address, err := wallets.ImportPubKey(pubKey)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported watch-only address: %s\n", address)
+	return cli.saveImported(wallets, rescan)
+}
+
+//导入WIF格式的私钥，address不为空时检查私钥对应的地址是否为address
+func (cli *CLI) importPrivKey(wif, address string, rescan bool) error {
+	wallets, err := wallet.NewWallets(cli.walletFile())
+	if err != nil {
+		return err
+	}
+	imported, err := wallets.ImportPrivateKey(wif)
+	if err != nil {
+		return err
+	}
+	if address != "" && imported != address {
+		return fmt.Errorf("%w: %s", wallet.ErrAddressMismatch, address)
+	}
+	fmt.Printf("Imported address: %s\n", imported)
+	return cli.saveImported(wallets, rescan)
+}
+
+//打印地址的WIF格式私钥
+func (cli *CLI) dumpPrivKey(address string) error {
+	wallets, err := wallet.NewWallets(cli.walletFile())
+	if err != nil {
+		return err
+	}
+	wif, err := wallets.DumpPrivateKey(address)
+	if err != nil {
+		return err
+	}
+	fmt.Println(wif)
+	return nil
+}
+
+//把钱包中所有私钥导出到file，文件已经存在时不会覆盖
+func (cli *CLI) dumpWallet(file string) error {
+	wallets, err := wallet.NewWallets(cli.walletFile())
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = wallets.Dump(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Dumped %d keys to %s\n", len(wallets.Wallets), file)
+	return nil
+}
+
+//从dumpwallet导出的文件中导入私钥
+func (cli *CLI) importWallet(file string, rescan bool) error {
+	wallets, err := wallet.NewWallets(cli.walletFile())
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	addresses, err := wallets.ImportDump(f)
+	if err != nil {
+		return err
+	}
+	for _, address := range addresses {
+		fmt.Printf("Imported address: %s\n", address)
+	}
+	if len(addresses) == 0 {
+		fmt.Println("没有需要导入的私钥")
+		return nil
+	}
+	return cli.saveImported(wallets, rescan)
+}
+
+//保存导入了地址的钱包，需要时重新扫描区块
+func (cli *CLI) saveImported(wallets *wallet.Wallets, rescan bool) error {
+	err := wallets.SaveToFile(cli.walletFile())
+	if err != nil {
+		return err
+	}
+	if !rescan {
+		fmt.Println("交易记录中还没有该地址的交易，需要时运行 rescanwallet")
+		return nil
+	}
+	return cli.rescanWallet(0)
 }
 
 //打印区块链函数调用
-func (cli *CLI) printChain() {
+func (cli *CLI) printChain(engine consensus.Engine) error {
 	//实例化一条链
-	bc := blockchain.NewBlockchain()  //因为已经有了链，不会重新创建链，所以接收的address设置为空
+	bc,err := cli.openBlockchain()  //因为已经有了链，不会重新创建链，所以接收的address设置为空
+	if err != nil {
+		return err
+	}
 	defer bc.Db().Close()
+	bc.SetEngine(engine)
 
 	//这里需要用到迭代区块链的思想
 	//创建一个迭代器
@@ -120,17 +500,19 @@ func (cli *CLI) printChain() {
 
 	for {
 
-		block := bci.Next()	//从顶端区块向前面的区块迭代
+		block,err := bci.Next()	//从顶端区块向前面的区块迭代
+		if err != nil {
+			return err
+		}
 
 		fmt.Printf("------======= 区块 %x ============\n", block.Hash)
 		fmt.Printf("时间戳:%v\n",block.Timestamp)
 		fmt.Printf("PrevHash:%x\n",block.PrevBlockHash)
 		//fmt.Printf("Data:%s\n",block.Data)
 		//fmt.Printf("Hash:%x\n",block.Hash)
-		//验证当前区块的pow
-		pow := pow.NewProofOfWork(block)
-		boolen := pow.Validate()
-		fmt.Printf("POW is %s\n",strconv.FormatBool(boolen))
+		//验证当前区块的封装
+		boolen := bc.Engine().VerifySeal(block)
+		fmt.Printf("Seal is %s\n",strconv.FormatBool(boolen))
 
 		for _,tx := range block.Transactions {
 			transaction := (*tx).String()
@@ -142,28 +524,398 @@ func (cli *CLI) printChain() {
 			break
 		}
 	}
+	return nil
 }
-//查找UTXO集中的交易数
-func (cli *CLI) reindexUTXO() {
-	bc := blockchain.NewBlockchain()
-	UTXOSet := utxo.UTXOSet{bc}
-	UTXOSet.Reindex() //在现实中如果能保证自己下载的链节点是完整的，可以忽略。
-	count := UTXOSet.CountTransactions()
+//重建UTXO集并打印其中的交易数，verify为true时先验证链上所有交易的签名
+func (cli *CLI) reindexUTXO(verify bool) error {
+	bc,err := cli.openBlockchain()
+	if err != nil {
+		return err
+	}
+	defer bc.Db().Close()
+	if verify {
+		start := time.Now()
+		err = bc.VerifyChain()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("All signatures are valid (%v)\n",time.Since(start).Round(time.Millisecond))
+	}
+	UTXOSet := utxo.UTXOSet{Blockchain: bc}
+	err = UTXOSet.Reindex() //在现实中如果能保证自己下载的链节点是完整的，可以忽略。
+	if err != nil {
+		return err
+	}
+	count,err := UTXOSet.CountTransactions()
+	if err != nil {
+		return err
+	}
 	fmt.Printf("Done!!! There are %d transactions in the UTXO set.\n", count)
+	return nil
+}
+
+//列出地址的交易记录，最新的在前
+func (cli *CLI) listTransactions(address string,count,skip int) error {
+	if !wallet.ValidateAddress(address) {
+		return wallet.ErrInvalidAddress
+	}
+	if !cli.cfg.AddrIndex {
+		return errors.New("address index is disabled, set addrindex = true in the config or BLOCKCHAIN_ADDRINDEX=true")
+	}
+	bc,err := cli.openBlockchain()
+	if err != nil {
+		return err
+	}
+	defer bc.Db().Close()
+
+	pubKeyHash := wallet.AddressPubKeyHash(address)
+	entries,err := addrindex.NewAddrIndex().Transactions(bc,address,count,skip)
+	if err != nil {
+		return err
+	}
+	tipHeight,err := bc.Height()
+	if err != nil {
+		return err
+	}
+	for _,entry := range entries {
+		b,err := bc.GetBlock(entry.BlockHash)
+		if err != nil {
+			return err
+		}
+		var tx *transaction.Transaction
+		for _,t := range b.Transactions {
+			if bytes.Equal(t.ID,entry.TxID) {
+				tx = t
+				break
+			}
+		}
+		if tx == nil {
+			return fmt.Errorf("%w: %x",blockchain.ErrTxNotFound,entry.TxID)
+		}
+
+		//花费了该地址的输出就是转出，对方为其他的收款地址；否则是转入，对方为付款地址
+		direction := "receive"
+		amount := entry.Received
+		var counterparties []string
+		if entry.Sent > 0 {
+			direction = "send"
+			amount = entry.Sent - entry.Received
+			for _,out := range tx.Vout {
+				if !out.IsLockedWithKey(pubKeyHash) {
+					counterparties = append(counterparties,string(wallet.PubKeyHashToAddress(out.PubkeyHash)))
+				}
+			}
+		} else if tx.IsCoinbase() {
+			counterparties = append(counterparties,"coinbase")
+		} else {
+			for _,vin := range tx.Vin {
+				counterparties = append(counterparties,string(wallet.PubKeyHashToAddress(wallet.HashPubKey(vin.PubKey))))
+			}
+		}
+		if len(counterparties) == 0 {
+			counterparties = append(counterparties,"-")
+		}
+
+		fmt.Printf("%x %s %d\n",entry.TxID,direction,amount)
+		fmt.Printf("  counterparties: %s\n",strings.Join(uniqueStrings(counterparties),", "))
+		fmt.Printf("  height: %d confirmations: %d\n",entry.Height,tipHeight-entry.Height+1)
+	}
+	return nil
+}
+
+//去掉重复的字符串，保持原来的顺序
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _,v := range values {
+		if !seen[v] {
+			seen[v] = true
+			result = append(result,v)
+		}
+	}
+	return result
+}
+
+//重新扫描区块，重建钱包的交易记录
+func (cli *CLI) rescanWallet(from int) error {
+	bc,err := cli.openBlockchain()
+	if err != nil {
+		return err
+	}
+	defer bc.Db().Close()
+
+	wallets,err := wallet.NewWallets(cli.walletFile())
+	if err != nil {
+		return err
+	}
+	l,err := ledger.NewLedger(cli.ledgerFile())
+	if err != nil {
+		return err
+	}
+	err = l.Rescan(bc,from,ledger.IsMineFunc(wallets))
+	if err != nil {
+		return err
+	}
+	err = l.SaveToFile(cli.ledgerFile())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Done! 扫描到高度 %d，钱包中有 %d 笔交易\n",l.Height,len(l.Txs))
+	return nil
+}
+
+//列出钱包中未花费的输出
+func (cli *CLI) listUnspent() error {
+	bc,err := cli.openBlockchain()
+	if err != nil {
+		return err
+	}
+	defer bc.Db().Close()
+
+	l,isMine,err := cli.syncLedger(bc)
+	if err != nil {
+		return err
+	}
+	for _,u := range l.Unspent(isMine) {
+		fmt.Printf("%x:%d %d %s confirmations: %d\n",u.Txid,u.Vout,u.Output.Value,
+			wallet.PubKeyHashToAddress(u.Output.PubkeyHash),l.Height-u.Height+1)
+	}
+	return nil
+}
+
+//显示钱包中的一笔交易
+func (cli *CLI) getTransaction(txid string) error {
+	id,err := hex.DecodeString(txid)
+	if err != nil {
+		return err
+	}
+	bc,err := cli.openBlockchain()
+	if err != nil {
+		return err
+	}
+	defer bc.Db().Close()
+
+	l,isMine,err := cli.syncLedger(bc)
+	if err != nil {
+		return err
+	}
+	wtx,err := l.GetTransaction(id)
+	if err != nil {
+		return err
+	}
+	received,sent := l.Amounts(wtx,isMine)
+	fmt.Printf("txid: %x\n",wtx.Tx.ID)
+	fmt.Printf("amount: %d\n",received-sent)
+	fmt.Printf("block: %x\n",wtx.BlockHash)
+	fmt.Printf("height: %d confirmations: %d\n",wtx.Height,l.Height-wtx.Height+1)
+	fmt.Println(wtx.Tx.String())
+	return nil
+}
+
+//创建from发送amount给to并支付fee手续费的未签名交易，打印出十六进制或者JSON编码
+func (cli *CLI) createRawTransaction(from,to string,amount,fee,minConf int,replaceable,asJSON bool) error {
+	if !wallet.ValidateAddress(from) || !wallet.ValidateAddress(to) {
+		return wallet.ErrInvalidAddress
+	}
+	bc,err := cli.openBlockchain()
+	if err != nil {
+		return err
+	}
+	defer bc.Db().Close()
+
+	raw,err := NewRawTransaction(from,to,amount,fee,minConf,replaceable,mempool.Mempool{Blockchain: bc})
+	if err != nil {
+		return err
+	}
+	return printRawTransaction(raw,asJSON)
+}
+
+//用钱包中的私钥签名原始交易，不需要区块链
+func (cli *CLI) signRawTransaction(encoded,sigHash string,asJSON bool) error {
+	hashType,err := transaction.ParseSigHashType(sigHash)
+	if err != nil {
+		return err
+	}
+	raw,err := readRawTransaction(encoded)
+	if err != nil {
+		return err
+	}
+	wallets,err := wallet.NewWallets(cli.walletFile())
+	if err != nil {
+		return err
+	}
+	signed,err := raw.Sign(wallets,hashType)
+	if err != nil {
+		return err
+	}
+	err = printRawTransaction(raw,asJSON)
+	if err != nil {
+		return err
+	}
+	//状态写到标准错误，标准输出可以直接交给sendrawtransaction
+	fmt.Fprintf(os.Stderr,"签名了 %d 个输入，complete: %t\n",signed,raw.Complete())
+	return nil
+}
+
+//把签名完成的原始交易放入交易池
+func (cli *CLI) sendRawTransaction(encoded string) error {
+	raw,err := readRawTransaction(encoded)
+	if err != nil {
+		return err
+	}
+	if !raw.Complete() {
+		return transaction.ErrIncompleteTx
+	}
+	bc,err := cli.openBlockchain()
+	if err != nil {
+		return err
+	}
+	defer bc.Db().Close()
+
+	pool := mempool.Mempool{Blockchain: bc}
+	err = pool.Add(&raw.Tx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("交易 %x 已放入交易池...\n", raw.Tx.ID)
+	return nil
+}
+
+//提高交易池中一笔钱包交易的手续费，fee为新的手续费，小于等于0时使用原来的两倍(至少增加1)
+func (cli *CLI) bumpFee(txid string,fee int) error {
+	id,err := hex.DecodeString(txid)
+	if err != nil {
+		return err
+	}
+	bc,err := cli.openBlockchain()
+	if err != nil {
+		return err
+	}
+	defer bc.Db().Close()
+	wallets,err := wallet.NewWallets(cli.walletFile())
+	if err != nil {
+		return err
+	}
+
+	pool := mempool.Mempool{Blockchain: bc}
+	raw,oldFee,err := BumpFee(wallets,pool,id,fee)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("手续费从 %d 提高到 %d，交易 %x 替换了 %x\n",oldFee,raw.Tx.Fee(raw.PrevOuts),raw.Tx.ID,id)
+	return nil
+}
+
+//解码命令行中的原始交易，"-"表示从标准输入读取
+func readRawTransaction(encoded string) (*transaction.RawTransaction,error) {
+	if encoded == "-" {
+		data,err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return nil,err
+		}
+		encoded = string(data)
+	}
+	return transaction.DecodeRawTransaction(encoded)
+}
+
+//打印原始交易的十六进制或者JSON编码
+func printRawTransaction(raw *transaction.RawTransaction,asJSON bool) error {
+	if !asJSON {
+		fmt.Println(raw.EncodeHex())
+		return nil
+	}
+	data,err := json.MarshalIndent(raw,"","  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+//把区块及其之后的区块从链上断开，其中的交易放回交易池
+func (cli *CLI) invalidateBlock(hash string) error {
+	blockHash,err := hex.DecodeString(hash)
+	if err != nil {
+		return err
+	}
+	bc,err := cli.openBlockchain()
+	if err != nil {
+		return err
+	}
+	defer bc.Db().Close()
+
+	disconnected,err := bc.InvalidateBlock(blockHash)
+	if err != nil {
+		return err
+	}
+	pool := mempool.Mempool{Blockchain: bc}
+	readded := 0
+	//从最早的区块开始放回，后面区块中的交易可能花费前面区块中的输出
+	for i := len(disconnected)-1; i >= 0; i-- {
+		for _,tx := range disconnected[i].Transactions {
+			if tx.IsCoinbase() {
+				continue
+			}
+			//依赖被断开的coinbase输出或者已经无效的交易放不回交易池，直接丢弃
+			if pool.Add(tx) == nil {
+				readded++
+			}
+		}
+	}
+	for _,b := range disconnected {
+		fmt.Printf("断开区块 %x\n",b.Hash)
+	}
+	fmt.Printf("%d 笔交易放回交易池，新的顶端为 %x\n",readded,bc.Tip())
+	return nil
+}
+
+//取消区块的无效标记并重新连接被断开的区块
+func (cli *CLI) reconsiderBlock(hash string,engine consensus.Engine) error {
+	blockHash,err := hex.DecodeString(hash)
+	if err != nil {
+		return err
+	}
+	bc,err := cli.openBlockchain()
+	if err != nil {
+		return err
+	}
+	defer bc.Db().Close()
+	bc.SetEngine(engine)
+
+	connected,err := bc.ReconsiderBlock(blockHash)
+	if err != nil {
+		return err
+	}
+	pool := mempool.Mempool{Blockchain: bc}
+	for _,b := range connected {
+		if err := pool.Remove(b.Transactions); err != nil {
+			return err
+		}
+		fmt.Printf("连接区块 %x\n",b.Hash)
+	}
+	fmt.Printf("新的顶端为 %x\n",bc.Tip())
+	return nil
 }
 
 //send方法
-func (cli *CLI) send(from,to string,amount int) {
+//mineNow为false时交易只放入交易池，replaceable为true时交易确认之前可以用bumpfee提高手续费
+//只花费确认数不少于minConf并且已经成熟、没有被交易池中的交易花费的输出，
+//minConf为0并且mineNow为false时还可以花费交易池中支付给from的输出
+func (cli *CLI) send(from,to string,amount,fee,minConf int,replaceable,mineNow bool,engine consensus.Engine) error {
 	if !wallet.ValidateAddress(from) {
-		log.Panic("ERROR: Address is not valid")
+		return wallet.ErrInvalidAddress
 	}
 	if !wallet.ValidateAddress(to) {
-		log.Panic("ERROR: Address is not valid")
+		return wallet.ErrInvalidAddress
 	}
 
-	bc := blockchain.NewBlockchain()
-	UTXOSet := utxo.UTXOSet{bc}
+	bc,err := cli.openBlockchain()
+	if err != nil {
+		return err
+	}
 	defer bc.Db().Close()
+	bc.SetEngine(engine)
+	pool := mempool.Mempool{Blockchain: bc}
 
 	//tx := NewUTXOTransaction(from,to,amount,bc)
 	////挖矿奖励的交易，把挖矿的奖励发送给矿工，这里的矿工默认为发送交易的地址
@@ -171,18 +923,139 @@ func (cli *CLI) send(from,to string,amount int) {
 
 	//挖出一个包含该交易的区块,此时区块还包含了-挖矿奖励的交易
 	//bc.MineBlock([]*transaction.Transaction{cbtx,tx})
-	tx := NewUTXOTransaction(from, to, amount, &UTXOSet)
-	cbTx := transaction.NewCoinbaseTX(from, "")
+	wallets, err := wallet.NewWallets(cli.walletFile())
+	if err != nil {
+		return err
+	}
+	//直接挖出的区块中没有交易池中的父交易，只能花费已经确认的输出
+	if mineNow && minConf < 1 {
+		minConf = 1
+	}
+	tx, err := NewUTXOTransaction(wallets, from, to, amount, fee, minConf, replaceable, pool)
+	if err != nil {
+		return err
+	}
+	if !mineNow {
+		if err := pool.Add(tx); err != nil {
+			return err
+		}
+		fmt.Printf("交易 %x 已放入交易池...\n", tx.ID)
+		return nil
+	}
+	cbTx, err := transaction.NewCoinbaseTX(from, "")
+	if err != nil {
+		return err
+	}
+	//手续费归挖出区块的from
+	cbTx.Vout[0].Value += fee
+	cbTx.ID = cbTx.TxID()
 	txs := []*transaction.Transaction{cbTx, tx}
-	newBlock := bc.MineBlock(txs)
-	UTXOSet.Update(newBlock)
+	//区块和UTXO集的变化在同一个事务中写入
+	_,err = bc.MineBlock(context.Background(),txs)
+	if err != nil {
+		return err
+	}
 	fmt.Println("发送成功...")
+	return nil
+}
+
+//挖矿，blocks个区块之后退出，blocks为0时一直挖到收到SIGINT/SIGTERM
+//readStdin为true时从标准输入读取交易放入交易池，挖矿期间数据库被这个进程独占，这是提交交易的唯一途径
+func (cli *CLI) mine(address string,blocks int,interval time.Duration,readStdin bool,engine consensus.Engine) error {
+	if !wallet.ValidateAddress(address) {
+		return wallet.ErrInvalidAddress
+	}
+
+	bc,err := cli.openBlockchain()
+	if err != nil {
+		return err
+	}
+	defer bc.Db().Close()
+	bc.SetEngine(engine)
+
+	ctx,cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal,1)
+	signal.Notify(sigs,os.Interrupt,syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		select {
+		case <-sigs:
+			fmt.Println("收到退出信号，停止挖矿...")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var m *miner.Miner
+	//交易池中新增交易时重新生成区块模板，OnAdd要在交易池被复制进区块模板函数之前设置
+	pool := mempool.Mempool{Blockchain: bc,OnAdd: func(*transaction.Transaction) {
+		m.NotifyTransactions(1)
+	}}
+	m = miner.NewMiner(bc,miner.PoolTemplate(address,pool))
+	if readStdin {
+		go submitTransactions(os.Stdin,pool)
+	}
+	mined := 0
+	err = m.Run(ctx,blocks,interval,func(newBlock *block.Block) error {
+		if err := pool.Remove(newBlock.Transactions); err != nil {
+			return err
+		}
+		mined++
+		fmt.Printf("挖出区块 %x，包含 %d 笔交易\n",newBlock.Hash,len(newBlock.Transactions))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("共挖出 %d 个区块\n",mined)
+	return nil
+}
+
+//submitTransactions读取的一行交易的最大长度(字节)
+const maxRawTransactionLine = 1<<20
+
+//从r中逐行读取十六进制或者JSON编码的交易放入交易池，一笔交易无效时打印错误并继续读取下一行
+func submitTransactions(r io.Reader,pool mempool.Mempool) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil,maxRawTransactionLine)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		raw,err := transaction.DecodeRawTransaction(line)
+		if err == nil && !raw.Complete() {
+			err = transaction.ErrIncompleteTx
+		}
+		if err == nil {
+			err = pool.Add(&raw.Tx)
+		}
+		if err != nil {
+			fmt.Println("ERROR:",err)
+			continue
+		}
+		fmt.Printf("交易 %x 已放入交易池...\n",raw.Tx.ID)
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Println("ERROR:",err)
+	}
 }
 
-//入口函数 
+//入口函数，命令执行出错时打印错误并以状态码1退出
 func (cli *CLI) Run() {
 	//判断命令行输入参数的个数，如果没有输入任何参数则打印提示输入参数信息
 	cli.validateArgs()
+	//解析命令之前的全局参数，args[0]为命令
+	args, err := cli.parseGlobalFlags()
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		os.Exit(1)
+	}
+	if len(args) < 1 {
+		cli.printUsage()
+		os.Exit(1)
+	}
 	//实例化flag集合
 	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
 	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
@@ -191,61 +1064,142 @@ func (cli *CLI) Run() {
 	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
 	printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
+	mineCmd := flag.NewFlagSet("mine", flag.ExitOnError)
+	listTransactionsCmd := flag.NewFlagSet("listtransactions", flag.ExitOnError)
+	rescanWalletCmd := flag.NewFlagSet("rescanwallet", flag.ExitOnError)
+	listUnspentCmd := flag.NewFlagSet("listunspent", flag.ExitOnError)
+	getTransactionCmd := flag.NewFlagSet("gettransaction", flag.ExitOnError)
+	invalidateBlockCmd := flag.NewFlagSet("invalidateblock", flag.ExitOnError)
+	reconsiderBlockCmd := flag.NewFlagSet("reconsiderblock", flag.ExitOnError)
+	importAddressCmd := flag.NewFlagSet("importaddress", flag.ExitOnError)
+	importPubKeyCmd := flag.NewFlagSet("importpubkey", flag.ExitOnError)
+	importPrivKeyCmd := flag.NewFlagSet("importprivkey", flag.ExitOnError)
+	dumpPrivKeyCmd := flag.NewFlagSet("dumpprivkey", flag.ExitOnError)
+	dumpWalletCmd := flag.NewFlagSet("dumpwallet", flag.ExitOnError)
+	importWalletCmd := flag.NewFlagSet("importwallet", flag.ExitOnError)
+	createRawTransactionCmd := flag.NewFlagSet("createrawtransaction", flag.ExitOnError)
+	signRawTransactionCmd := flag.NewFlagSet("signrawtransaction", flag.ExitOnError)
+	sendRawTransactionCmd := flag.NewFlagSet("sendrawtransaction", flag.ExitOnError)
+	bumpFeeCmd := flag.NewFlagSet("bumpfee", flag.ExitOnError)
 	//注册flag标志符
 	getBalanceAddress := getBalanceCmd.String("address", "", "The address to get balance for")
+	getBalanceMinConf := getBalanceCmd.Int("minconf", 1, "Minimum number of confirmations for confirmed balance")
+	createWalletType := createWalletCmd.String("type", wallet.P256.String(), "Key type: p256, secp256k1, ed25519 or schnorr")
+	reindexUTXOVerify := reindexUTXOCmd.Bool("verify", false, "Verify all transaction signatures before rebuilding")
 	createBlockchainAddress := createBlockchainCmd.String("address", "", "The address to send genesis block reward to")
 	sendFrom := sendCmd.String("from", "", "Source wallet address")
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
+	sendFee := sendCmd.Int("fee", 0, "Fee paid to the miner")
+	sendRBF := sendCmd.Bool("rbf", false, "Allow the transaction to be replaced by one paying a higher fee")
+	createBlockchainConsensus := cli.addConsensusFlags(createBlockchainCmd)
+	sendConsensus := cli.addConsensusFlags(sendCmd)
+	printChainConsensus := cli.addConsensusFlags(printChainCmd)
+	sendMinConf := sendCmd.Int("minconf", 1, "Only spend outputs with at least this many confirmations, 0 also spends unconfirmed mempool outputs with -mine=false")
+	sendMine := sendCmd.Bool("mine", true, "Mine a block with the transaction immediately instead of adding it to the mempool")
+	mineAddress := mineCmd.String("address", cli.cfg.MinerAddress, "The address to send block rewards to")
+	mineBlocks := mineCmd.Int("blocks", 0, "Number of blocks to mine, 0 to mine until interrupted")
+	mineInterval := mineCmd.Duration("interval", 0, "Time to wait between blocks")
+	mineStdin := mineCmd.Bool("stdin", false, "Read signed transactions from standard input, one per line, and add them to the mempool")
+	mineConsensus := cli.addConsensusFlags(mineCmd)
+	listTransactionsAddress := listTransactionsCmd.String("address", "", "The address to list transactions for")
+	listTransactionsCount := listTransactionsCmd.Int("count", 10, "Number of transactions to list")
+	listTransactionsSkip := listTransactionsCmd.Int("skip", 0, "Number of most recent transactions to skip")
+	rescanWalletFrom := rescanWalletCmd.Int("from", 0, "Height to start rescanning from")
+	getTransactionTxid := getTransactionCmd.String("txid", "", "ID of the transaction")
+	invalidateBlockHash := invalidateBlockCmd.String("hash", "", "Hash of the block to invalidate")
+	reconsiderBlockHash := reconsiderBlockCmd.String("hash", "", "Hash of the block to reconsider")
+	reconsiderBlockConsensus := cli.addConsensusFlags(reconsiderBlockCmd)
+	importAddressAddress := importAddressCmd.String("address", "", "The watch-only address to import")
+	importAddressRescan := importAddressCmd.Bool("rescan", true, "Rescan the blockchain for transactions of the address")
+	importPubKeyPubKey := importPubKeyCmd.String("pubkey", "", "Hex encoded public key to import")
+	importPubKeyRescan := importPubKeyCmd.Bool("rescan", true, "Rescan the blockchain for transactions of the public key")
+	importPrivKeyKey := importPrivKeyCmd.String("key", "", "WIF encoded private key to import")
+	importPrivKeyAddress := importPrivKeyCmd.String("address", "", "Expected address of the private key")
+	importPrivKeyRescan := importPrivKeyCmd.Bool("rescan", true, "Rescan the blockchain for transactions of the address")
+	dumpPrivKeyAddress := dumpPrivKeyCmd.String("address", "", "The address to dump the private key for")
+	dumpWalletFile := dumpWalletCmd.String("file", "", "File to write the private keys to")
+	importWalletFile := importWalletCmd.String("file", "", "File written by dumpwallet")
+	createRawTransactionFrom := createRawTransactionCmd.String("from", "", "Source address, its private key is not needed")
+	createRawTransactionTo := createRawTransactionCmd.String("to", "", "Destination address")
+	createRawTransactionAmount := createRawTransactionCmd.Int("amount", 0, "Amount to send")
+	createRawTransactionMinConf := createRawTransactionCmd.Int("minconf", 1, "Only spend outputs with at least this many confirmations, 0 also spends unconfirmed mempool outputs")
+	createRawTransactionFee := createRawTransactionCmd.Int("fee", 0, "Fee paid to the miner")
+	createRawTransactionRBF := createRawTransactionCmd.Bool("rbf", false, "Allow the transaction to be replaced by one paying a higher fee")
+	createRawTransactionJSON := createRawTransactionCmd.Bool("json", false, "Print the transaction as JSON instead of hex")
+	signRawTransactionTx := signRawTransactionCmd.String("tx", "", "Hex or JSON encoded transaction, - to read from stdin")
+	signRawTransactionSigHash := signRawTransactionCmd.String("sighash", transaction.SigHashAll.String(), "Signature hash type: ALL, NONE or SINGLE, optionally |ANYONECANPAY")
+	signRawTransactionJSON := signRawTransactionCmd.Bool("json", false, "Print the transaction as JSON instead of hex")
+	sendRawTransactionTx := sendRawTransactionCmd.String("tx", "", "Hex or JSON encoded signed transaction, - to read from stdin")
+	bumpFeeTxid := bumpFeeCmd.String("txid", "", "ID of the mempool transaction to replace")
+	bumpFeeFee := bumpFeeCmd.Int("fee", 0, "New fee, 0 to double the current fee")
+	importWalletRescan := importWalletCmd.Bool("rescan", true, "Rescan the blockchain for transactions of the imported addresses")
 	
-	switch os.Args[1] {		//os.Args为一个保存输入命令的切片
+	switch args[0] {		//args为一个保存输入命令的切片
 	case "getbalance":
-		err := getBalanceCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Panic(err)
-		}
+		err = getBalanceCmd.Parse(args[1:])
 	case "createblockchain":
-		err := createBlockchainCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Panic(err)
-		}
+		err = createBlockchainCmd.Parse(args[1:])
 	case "createwallet":
-		err := createWalletCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Panic(err)
-		}
+		err = createWalletCmd.Parse(args[1:])
 	case "listaddresses":
-		err := listAddressesCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Panic(err)
-		}
+		err = listAddressesCmd.Parse(args[1:])
 	case "printchain":
-		err := printChainCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Panic(err)
-		}
+		err = printChainCmd.Parse(args[1:])
 	case "send":
-		err := sendCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Panic(err)
-		}
+		err = sendCmd.Parse(args[1:])
+	case "mine":
+		err = mineCmd.Parse(args[1:])
 	case "reindexutxo":
-		err := reindexUTXOCmd.Parse(os.Args[2:])
-		if err != nil {
-			log.Panic(err)
-		}
+		err = reindexUTXOCmd.Parse(args[1:])
+	case "listtransactions":
+		err = listTransactionsCmd.Parse(args[1:])
+	case "rescanwallet":
+		err = rescanWalletCmd.Parse(args[1:])
+	case "listunspent":
+		err = listUnspentCmd.Parse(args[1:])
+	case "gettransaction":
+		err = getTransactionCmd.Parse(args[1:])
+	case "invalidateblock":
+		err = invalidateBlockCmd.Parse(args[1:])
+	case "reconsiderblock":
+		err = reconsiderBlockCmd.Parse(args[1:])
+	case "importaddress":
+		err = importAddressCmd.Parse(args[1:])
+	case "importpubkey":
+		err = importPubKeyCmd.Parse(args[1:])
+	case "importprivkey":
+		err = importPrivKeyCmd.Parse(args[1:])
+	case "dumpprivkey":
+		err = dumpPrivKeyCmd.Parse(args[1:])
+	case "dumpwallet":
+		err = dumpWalletCmd.Parse(args[1:])
+	case "importwallet":
+		err = importWalletCmd.Parse(args[1:])
+	case "createrawtransaction":
+		err = createRawTransactionCmd.Parse(args[1:])
+	case "signrawtransaction":
+		err = signRawTransactionCmd.Parse(args[1:])
+	case "sendrawtransaction":
+		err = sendRawTransactionCmd.Parse(args[1:])
+	case "bumpfee":
+		err = bumpFeeCmd.Parse(args[1:])
 	default:
 		cli.printUsage()
 		os.Exit(1)
 	}
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		os.Exit(1)
+	}
 
 	//进入被解析出的命令，进一步操作
 	if getBalanceCmd.Parsed() {
-		if *getBalanceAddress == "" {
+		if *getBalanceAddress == "" || *getBalanceMinConf < 0 {
 			getBalanceCmd.Usage()
 			os.Exit(1)
 		}
-		cli.getBalance(*getBalanceAddress)
+		err = cli.getBalance(*getBalanceAddress, *getBalanceMinConf)
 	}
 
 	if createBlockchainCmd.Parsed() {
@@ -253,75 +1207,308 @@ func (cli *CLI) Run() {
 			createBlockchainCmd.Usage()
 			os.Exit(1)
 		}
-		cli.createBlockchain(*createBlockchainAddress)
+		var engine consensus.Engine
+		engine, err = createBlockchainConsensus.engine()
+		if err == nil {
+			err = cli.createBlockchain(*createBlockchainAddress,engine)
+		}
 	}
 
 	if createWalletCmd.Parsed() {
-		cli.createWallet()
+		err = cli.createWallet(*createWalletType)
 	}
 	if listAddressesCmd.Parsed() {
-		cli.listAddresses()
+		err = cli.listAddresses()
 	}
 
 	if printChainCmd.Parsed() {
-		cli.printChain()
+		var engine consensus.Engine
+		engine, err = printChainConsensus.engine()
+		if err == nil {
+			err = cli.printChain(engine)
+		}
 	}
 
 	if reindexUTXOCmd.Parsed() {
-		cli.reindexUTXO()
+		err = cli.reindexUTXO(*reindexUTXOVerify)
+	}
+
+	if listTransactionsCmd.Parsed() {
+		if *listTransactionsAddress == "" || *listTransactionsCount < 0 || *listTransactionsSkip < 0 {
+			listTransactionsCmd.Usage()
+			os.Exit(1)
+		}
+		err = cli.listTransactions(*listTransactionsAddress, *listTransactionsCount, *listTransactionsSkip)
+	}
+
+	if rescanWalletCmd.Parsed() {
+		if *rescanWalletFrom < 0 {
+			rescanWalletCmd.Usage()
+			os.Exit(1)
+		}
+		err = cli.rescanWallet(*rescanWalletFrom)
+	}
+
+	if listUnspentCmd.Parsed() {
+		err = cli.listUnspent()
+	}
+
+	if getTransactionCmd.Parsed() {
+		if *getTransactionTxid == "" {
+			getTransactionCmd.Usage()
+			os.Exit(1)
+		}
+		err = cli.getTransaction(*getTransactionTxid)
+	}
+
+	if invalidateBlockCmd.Parsed() {
+		if *invalidateBlockHash == "" {
+			invalidateBlockCmd.Usage()
+			os.Exit(1)
+		}
+		err = cli.invalidateBlock(*invalidateBlockHash)
+	}
+
+	if reconsiderBlockCmd.Parsed() {
+		if *reconsiderBlockHash == "" {
+			reconsiderBlockCmd.Usage()
+			os.Exit(1)
+		}
+		var engine consensus.Engine
+		engine, err = reconsiderBlockConsensus.engine()
+		if err == nil {
+			err = cli.reconsiderBlock(*reconsiderBlockHash, engine)
+		}
+	}
+
+	if importAddressCmd.Parsed() {
+		if *importAddressAddress == "" {
+			importAddressCmd.Usage()
+			os.Exit(1)
+		}
+		err = cli.importAddress(*importAddressAddress, *importAddressRescan)
+	}
+
+	if importPubKeyCmd.Parsed() {
+		if *importPubKeyPubKey == "" {
+			importPubKeyCmd.Usage()
+			os.Exit(1)
+		}
+		err = cli.importPubKey(*importPubKeyPubKey, *importPubKeyRescan)
+	}
+
+	if importPrivKeyCmd.Parsed() {
+		if *importPrivKeyKey == "" {
+			importPrivKeyCmd.Usage()
+			os.Exit(1)
+		}
+		err = cli.importPrivKey(*importPrivKeyKey, *importPrivKeyAddress, *importPrivKeyRescan)
+	}
+
+	if dumpPrivKeyCmd.Parsed() {
+		if *dumpPrivKeyAddress == "" {
+			dumpPrivKeyCmd.Usage()
+			os.Exit(1)
+		}
+		err = cli.dumpPrivKey(*dumpPrivKeyAddress)
+	}
+
+	if dumpWalletCmd.Parsed() {
+		if *dumpWalletFile == "" {
+			dumpWalletCmd.Usage()
+			os.Exit(1)
+		}
+		err = cli.dumpWallet(*dumpWalletFile)
+	}
+
+	if importWalletCmd.Parsed() {
+		if *importWalletFile == "" {
+			importWalletCmd.Usage()
+			os.Exit(1)
+		}
+		err = cli.importWallet(*importWalletFile, *importWalletRescan)
+	}
+
+	if createRawTransactionCmd.Parsed() {
+		if *createRawTransactionFrom == "" || *createRawTransactionTo == "" || *createRawTransactionAmount <= 0 || *createRawTransactionFee < 0 || *createRawTransactionMinConf < 0 {
+			createRawTransactionCmd.Usage()
+			os.Exit(1)
+		}
+		err = cli.createRawTransaction(*createRawTransactionFrom, *createRawTransactionTo, *createRawTransactionAmount, *createRawTransactionFee, *createRawTransactionMinConf, *createRawTransactionRBF, *createRawTransactionJSON)
+	}
+
+	if signRawTransactionCmd.Parsed() {
+		if *signRawTransactionTx == "" {
+			signRawTransactionCmd.Usage()
+			os.Exit(1)
+		}
+		err = cli.signRawTransaction(*signRawTransactionTx, *signRawTransactionSigHash, *signRawTransactionJSON)
+	}
+
+	if sendRawTransactionCmd.Parsed() {
+		if *sendRawTransactionTx == "" {
+			sendRawTransactionCmd.Usage()
+			os.Exit(1)
+		}
+		err = cli.sendRawTransaction(*sendRawTransactionTx)
+	}
+
+	if bumpFeeCmd.Parsed() {
+		if *bumpFeeTxid == "" || *bumpFeeFee < 0 {
+			bumpFeeCmd.Usage()
+			os.Exit(1)
+		}
+		err = cli.bumpFee(*bumpFeeTxid, *bumpFeeFee)
 	}
 
 	if sendCmd.Parsed() {
-		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
+		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 || *sendFee < 0 || *sendMinConf < 0 {
 			sendCmd.Usage()
 			os.Exit(1)
 		}
-		cli.send(*sendFrom, *sendTo, *sendAmount)
+		var engine consensus.Engine
+		engine, err = sendConsensus.engine()
+		if err == nil {
+			err = cli.send(*sendFrom, *sendTo, *sendAmount, *sendFee, *sendMinConf, *sendRBF, *sendMine, engine)
+		}
+	}
+
+	if mineCmd.Parsed() {
+		if *mineAddress == "" || *mineBlocks < 0 {
+			mineCmd.Usage()
+			os.Exit(1)
+		}
+		var engine consensus.Engine
+		engine, err = mineConsensus.engine()
+		if err == nil {
+			err = cli.mine(*mineAddress, *mineBlocks, *mineInterval, *mineStdin, engine)
+		}
+	}
+
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		os.Exit(1)
 	}
 }
 
 
-//发送币操作,相当于创建一笔未花费输出交易
-func NewUTXOTransaction(from,to string,amount int,UTXOSet *utxo.UTXOSet) *transaction.Transaction {
+//发送币操作,相当于创建一笔未花费输出交易，只花费确认数不少于minConf并且已经成熟的输出，
+//不花费交易池中的交易已经花费的输出，minConf为0时还可以花费交易池中支付给from的输出。
+//fee为支付给矿工的手续费，replaceable为true时交易确认之前可以用bumpfee提高手续费。
+//余额不足时返回utxo.ErrInsufficientFunds
+func NewUTXOTransaction(wallets *wallet.Wallets,from,to string,amount,fee,minConf int,replaceable bool,pool mempool.Mempool) (*transaction.Transaction,error) {
+	//只读地址和不在钱包中的地址不能签名
+	_,err := wallets.GetWallet(from)
+	if err != nil {
+		return nil,err
+	}
+	raw,err := NewRawTransaction(from,to,amount,fee,minConf,replaceable,pool)
+	if err != nil {
+		return nil,err
+	}
+	_,err = raw.Sign(wallets,transaction.SigHashAll)
+	if err != nil {
+		return nil,err
+	}
+	return &raw.Tx,nil
+}
+
+//创建from发送amount给to并支付fee手续费的未签名交易，找零回到from，不需要from的私钥。
+//交易中带上每个输入引用的输出，可以在没有区块链的机器上签名
+func NewRawTransaction(from,to string,amount,fee,minConf int,replaceable bool,pool mempool.Mempool) (*transaction.RawTransaction,error) {
 	var inputs []transaction.TXInput
 	var outputs []transaction.TXOutput
-	//validOutputs是一个存放要用到的未花费输出的交易/输出的map 
-	//acc,validOutputs := bc.FindSpendableOutputs(from,amount)
-	wallets,err := wallet.NewWallets()
-	if err != nil {
-		log.Panic(err)
-	}
-	_wallet := wallets.GetWallet(from)
-	pubKeyHash := wallet.HashPubKey(_wallet.PublicKey)
-	acc, validOutputs := UTXOSet.FindSpendableOutputs(pubKeyHash, amount)
-	if acc < amount {
-		log.Panic("ERROR:Not enough tokens...")
-	}
-	//通过validOutputs里面的数据来放入建立一个输入列表
-	for txid,outs := range validOutputs {
-		//反序列化得到txID
-		txID,err := hex.DecodeString(txid)
-		if err != nil {
-			log.Panic(err)
+	var prevOuts []transaction.TXOutput
+	pubKeyHash := wallet.AddressPubKeyHash(from)
+	coins,acc,err := pool.SelectCoins(pubKeyHash,amount+fee,minConf)
+	if err != nil {
+		return nil,err
+	}
+	if acc < amount+fee {
+		return nil,utxo.ErrInsufficientFunds
+	}
+	//通过选中的输出来建立一个输入列表
+	for _,coin := range coins {
+		inputs = append(inputs,transaction.TXInput{Txid: coin.Txid,Vout: coin.Vout})
+		prevOuts = append(prevOuts,coin.Output)
+	}
+	//建立一个输出列表，输出0支付给to，输出1是找零，bumpfee按这个顺序找到找零(见changeOutput)
+	outputs = append(outputs,*transaction.NewTXOutput(amount,to))
+	if acc > amount+fee {
+		outputs = append(outputs,*transaction.NewTXOutput(acc - amount - fee,from)) //相当于找零
+	}
+	tx := transaction.Transaction{Vin: inputs,Vout: outputs,Replaceable: replaceable}
+	tx.ID = tx.TxID()
+
+	return &transaction.RawTransaction{Tx: tx,PrevOuts: prevOuts},nil
+}
+
+//交易不能用bumpfee提高手续费
+var (
+	ErrNotReplaceable = errors.New("transaction does not signal replaceability")
+	ErrNoChange = errors.New("transaction has no change output to pay the higher fee")
+)
+
+//返回NewRawTransaction创建的交易的找零输出的序号，没有找零时返回-1。
+//序号0是支付给收款地址的输出，找零是之后支付回第一个输入所属地址的输出，收款地址和发送地址相同时也不会混淆
+func changeOutput(tx transaction.Transaction,prevOuts []transaction.TXOutput) int {
+	if len(prevOuts) == 0 {
+		return -1
+	}
+	for i := 1; i < len(tx.Vout); i++ {
+		if bytes.Equal(tx.Vout[i].PubkeyHash,prevOuts[0].PubkeyHash) {
+			return i
 		}
-		//遍历输出outs切片,得到TXInput里的Vout字段值
-		for _,out := range outs {
-			//input := transaction.TXInput{txID,out,from}
-			input := transaction.TXInput{txID,out,nil,_wallet.PublicKey}
-			inputs = append(inputs,input)
+	}
+	return -1
+}
+
+/*
+	用更高的手续费替换交易池中一笔可以替换的交易：增加的手续费从找零(见changeOutput)中扣除，
+没有找零或者找零扣除之后不剩下金额时返回ErrNoChange，输出的个数和序号都不会改变。fee为新的手续费，小于等于0时使用原来的两倍(至少增加1)。
+重新签名后放入交易池替换原来的交易，返回新的交易和原来的手续费
+*/
+func BumpFee(wallets *wallet.Wallets,pool mempool.Mempool,txid []byte,fee int) (*transaction.RawTransaction,int,error) {
+	tx,prevOuts,err := pool.Get(txid)
+	if err != nil {
+		return nil,0,err
+	}
+	if !tx.Replaceable {
+		return nil,0,ErrNotReplaceable
+	}
+	oldFee := tx.Fee(prevOuts)
+	if fee <= 0 {
+		fee = oldFee*2
+		if fee <= oldFee {
+			fee = oldFee+1
 		}
 	}
-	//建立一个输出列表
-	//outputs = append(outputs,transaction.TXOutput{amount,to})
-	outputs = append(outputs,*transaction.NewTXOutput(amount,to))
-	if acc > amount {
-		//outputs = append(outputs,transaction.TXOutput{acc - amount,from}) //相当于找零
-		outputs = append(outputs,*transaction.NewTXOutput(acc - amount,from)) //相当于找零
+	if fee <= oldFee {
+		return nil,0,fmt.Errorf("%w: %d <= %d",mempool.ErrInsufficientFee,fee,oldFee)
+	}
+
+	bumped := transaction.Transaction{Vin: make([]transaction.TXInput,len(tx.Vin)),Vout: append([]transaction.TXOutput{},tx.Vout...),Replaceable: true}
+	for i,vin := range tx.Vin {
+		bumped.Vin[i] = transaction.TXInput{Txid: vin.Txid,Vout: vin.Vout}
+	}
+	change := changeOutput(bumped,prevOuts)
+	//找零必须留下大于0的金额，删除输出会改变其他输出的序号
+	if change < 0 || bumped.Vout[change].Value <= fee-oldFee {
+		return nil,0,ErrNoChange
 	}
-	tx := transaction.Transaction{nil,inputs,outputs}
-	//tx.SetID()
-	tx.ID = tx.Hash()
-	UTXOSet.Blockchain.SignTransaction(&tx, _wallet.PrivateKey)
+	bumped.Vout[change].Value -= fee-oldFee
 
-	return &tx
+	raw := &transaction.RawTransaction{Tx: bumped,PrevOuts: prevOuts}
+	_,err = raw.Sign(wallets,transaction.SigHashAll)
+	if err != nil {
+		return nil,0,err
+	}
+	if !raw.Complete() {
+		return nil,0,transaction.ErrIncompleteTx
+	}
+	err = pool.Add(&raw.Tx)
+	if err != nil {
+		return nil,0,err
+	}
+	return raw,oldFee,nil
 }
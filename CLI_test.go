@@ -0,0 +1,254 @@
+package CLI
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go_code/A_golang_blockchain/blockchain"
+	"go_code/A_golang_blockchain/chaincfg"
+	"go_code/A_golang_blockchain/consensus"
+	"go_code/A_golang_blockchain/mempool"
+	"go_code/A_golang_blockchain/miner"
+	"go_code/A_golang_blockchain/transaction"
+	"go_code/A_golang_blockchain/utxo"
+	"go_code/A_golang_blockchain/wallet"
+)
+
+//在regtest上创建一条链，挖到创世区块的coinbase输出成熟为止
+func newTestChain(t *testing.T) (*blockchain.Blockchain, *wallet.Wallets, string) {
+	t.Helper()
+	if err := chaincfg.SetActiveNet("regtest"); err != nil {
+		t.Fatal(err)
+	}
+	ws := &wallet.Wallets{Wallets: map[string]*wallet.Wallet{}}
+	addr, err := ws.CreateWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc, err := blockchain.CreateBlockchain(filepath.Join(t.TempDir(), "chain.db"), addr, consensus.NewDev())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bc.Db().Close() })
+	for i := 0; i < chaincfg.ActiveNetParams.CoinbaseMaturity; i++ {
+		cb, err := transaction.NewCoinbaseTX(addr, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bc.MineBlock(context.Background(), []*transaction.Transaction{cb}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return bc, ws, addr
+}
+
+//增加的手续费只从找零中扣除，输出的个数和序号不变；找零不够时拒绝
+func TestBumpFee(t *testing.T) {
+	subsidy := chaincfg.ActiveNetParams.Subsidy
+	tests := []struct {
+		name    string
+		toSelf  bool //收款地址和发送地址相同
+		amount  int
+		fee     int
+		newFee  int
+		wantErr error
+	}{
+		{name: "change pays the increase", amount: 20, fee: 1, newFee: 5},
+		{name: "payment to self", toSelf: true, amount: 20, fee: 1, newFee: 5},
+		{name: "no change", amount: subsidy - 1, fee: 1, newFee: 2, wantErr: ErrNoChange},
+		{name: "change used up", amount: subsidy - 3, fee: 1, newFee: 3, wantErr: ErrNoChange},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bc, ws, from := newTestChain(t)
+			//收款地址也在钱包中，不能靠地址是否属于钱包来区分找零
+			to, err := ws.CreateWallet()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.toSelf {
+				to = from
+			}
+			pool := mempool.Mempool{Blockchain: bc}
+			tx, err := NewUTXOTransaction(ws, from, to, tt.amount, tt.fee, 1, true, pool)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := pool.Add(tx); err != nil {
+				t.Fatal(err)
+			}
+
+			raw, oldFee, err := BumpFee(ws, pool, tx.ID, tt.newFee)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("BumpFee = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if _, _, err := pool.Get(tx.ID); err != nil {
+					t.Fatalf("original transaction left the mempool: %v", err)
+				}
+				return
+			}
+			if oldFee != tt.fee {
+				t.Errorf("old fee = %d, want %d", oldFee, tt.fee)
+			}
+			bumped := raw.Tx
+			if len(bumped.Vout) != len(tx.Vout) {
+				t.Fatalf("outputs = %d, want %d", len(bumped.Vout), len(tx.Vout))
+			}
+			if bumped.Vout[0].Value != tt.amount {
+				t.Errorf("payment = %d, want %d", bumped.Vout[0].Value, tt.amount)
+			}
+			if want := tx.Vout[1].Value - (tt.newFee - tt.fee); bumped.Vout[1].Value != want {
+				t.Errorf("change = %d, want %d", bumped.Vout[1].Value, want)
+			}
+			if fee := bumped.Fee(raw.PrevOuts); fee != tt.newFee {
+				t.Errorf("fee = %d, want %d", fee, tt.newFee)
+			}
+			if _, _, err := pool.Get(tx.ID); !errors.Is(err, mempool.ErrTxNotInPool) {
+				t.Errorf("replaced transaction still in mempool: %v", err)
+			}
+		})
+	}
+}
+
+//连续两次从同一个地址发送，第二笔交易不花费第一笔交易在交易池中已经花费的输出
+func TestSendTwiceFromOneAddress(t *testing.T) {
+	//创世区块和第一个区块的coinbase输出在下一个区块中成熟，from有两个可以花费的输出
+	bc, ws, from := newTestChain(t)
+	to, err := ws.CreateWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := mempool.Mempool{Blockchain: bc}
+	spent := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		tx, err := NewUTXOTransaction(ws, from, to, 20, 1, 1, false, pool)
+		if err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+		for _, vin := range tx.Vin {
+			key := string(blockchain.OutpointKey(vin.Txid, vin.Vout))
+			if spent[key] {
+				t.Fatalf("send %d spends %x output %d again", i, vin.Txid, vin.Vout)
+			}
+			spent[key] = true
+		}
+		if err := pool.Add(tx); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+	}
+	//全部成熟的输出都已经被交易池中的交易花费
+	if _, err := NewUTXOTransaction(ws, from, to, 20, 1, 1, false, pool); !errors.Is(err, utxo.ErrInsufficientFunds) {
+		t.Fatalf("third send = %v, want %v", err, utxo.ErrInsufficientFunds)
+	}
+}
+
+//mine -stdin读取的交易放入交易池并通知矿工，无效的行不会中断读取
+func TestSubmitTransactions(t *testing.T) {
+	bc, ws, from := newTestChain(t)
+	added := 0
+	pool := mempool.Mempool{Blockchain: bc, OnAdd: func(*transaction.Transaction) {
+		added++
+	}}
+	raw, err := NewRawTransaction(from, from, 20, 1, 1, false, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := raw.Sign(ws, transaction.SigHashAll); err != nil {
+		t.Fatal(err)
+	}
+	unsigned, err := NewRawTransaction(from, from, 10, 1, 1, false, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := strings.Join([]string{"not a transaction", "", unsigned.EncodeHex(), raw.EncodeHex()}, "\n")
+	submitTransactions(strings.NewReader(input), pool)
+	if added != 1 {
+		t.Fatalf("OnAdd called %d times, want 1", added)
+	}
+	if _, _, err := pool.Get(raw.Tx.ID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//钱包用-minconf 0花费交易池中父交易的输出，手续费高的子交易把没有手续费的父交易一起带进区块模板(CPFP)
+func TestChildPaysForParent(t *testing.T) {
+	bc, ws, from := newTestChain(t)
+	to, err := ws.CreateWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := mempool.Mempool{Blockchain: bc}
+	send := func(from, to string, amount, fee, minConf int) *transaction.Transaction {
+		t.Helper()
+		tx, err := NewUTXOTransaction(ws, from, to, amount, fee, minConf, false, pool)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pool.Add(tx); err != nil {
+			t.Fatal(err)
+		}
+		return tx
+	}
+	other := send(from, from, 20, 3, 1)
+	parent := send(from, to, 20, 0, 1)
+
+	//to只有交易池中父交易支付的输出
+	if _, err := NewUTXOTransaction(ws, to, to, 10, 10, 1, false, pool); !errors.Is(err, utxo.ErrInsufficientFunds) {
+		t.Fatalf("send with minconf 1 = %v, want %v", err, utxo.ErrInsufficientFunds)
+	}
+	child := send(to, to, 5, 10, 0)
+	if len(child.Vin) != 1 || !bytes.Equal(child.Vin[0].Txid, parent.ID) {
+		t.Fatalf("child does not spend the parent")
+	}
+
+	//区块模板只放得下两笔交易：父交易和子交易整体的手续费率高于other
+	height, err := bc.Height()
+	if err != nil {
+		t.Fatal(err)
+	}
+	descs, _, err := pool.Descs(height + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := 0
+	for _, desc := range descs {
+		if !bytes.Equal(desc.Tx.ID, other.ID) {
+			size += desc.Size
+		}
+	}
+	defer func(max int) { miner.MaxTemplateSize = max }(miner.MaxTemplateSize)
+	miner.MaxTemplateSize = size
+	addr, err := ws.CreateWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txs, err := miner.PoolTemplate(addr, pool)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != 3 || !bytes.Equal(txs[1].ID, parent.ID) || !bytes.Equal(txs[2].ID, child.ID) {
+		t.Fatalf("template = %d transactions, want coinbase, parent, child", len(txs))
+	}
+	if want := chaincfg.ActiveNetParams.Subsidy + 10; txs[0].Vout[0].Value != want {
+		t.Errorf("coinbase = %d, want %d", txs[0].Vout[0].Value, want)
+	}
+}
+
+//无效地址在打开数据库之前返回错误，不会因为解码出的数据太短而panic
+func TestGetBalanceInvalidAddress(t *testing.T) {
+	if err := chaincfg.SetActiveNet("regtest"); err != nil {
+		t.Fatal(err)
+	}
+	cli := &CLI{}
+	for _, address := range []string{"", "1", "11111", "not an address"} {
+		if err := cli.getBalance(address, 1); !errors.Is(err, wallet.ErrInvalidAddress) {
+			t.Errorf("getBalance(%q) = %v, want %v", address, err, wallet.ErrInvalidAddress)
+		}
+	}
+}
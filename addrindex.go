@@ -0,0 +1,263 @@
+package addrindex
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"github.com/boltdb/bolt"
+	"go_code/A_golang_blockchain/block"
+	"go_code/A_golang_blockchain/blockchain"
+	"go_code/A_golang_blockchain/transaction"
+	"go_code/A_golang_blockchain/wallet"
+)
+
+/*
+	可选的地址历史索引：记录每一笔支付给某个公钥哈希或者花费其输出的交易。
+注册到区块链之后和区块在同一个数据库事务中更新。
+索引中的键为 公钥哈希 + 8字节大端序的区块高度 + 交易ID，同一地址的记录按高度排列
+*/
+const (
+	indexBucket = "addrindex"
+	//键bestBlockKey对应索引所反映的顶端区块哈希
+	metaBucket = "addrindex_meta"
+)
+
+var bestBlockKey = []byte("best")
+
+//一笔交易对某个地址的影响
+type Entry struct {
+	TxID		[]byte
+	Height		int
+	BlockHash	[]byte
+	Received	int //交易输出中支付给该地址的金额
+	Sent		int //交易输入中花费掉的该地址的金额
+}
+
+//索引中保存的值，交易ID和高度已经在键中
+type entryValue struct {
+	BlockHash	[]byte
+	Received	int
+	Sent		int
+}
+
+//地址历史索引，实现了blockchain.Indexer
+type AddrIndex struct{}
+
+//实例化一个地址历史索引
+func NewAddrIndex() *AddrIndex {
+	return &AddrIndex{}
+}
+
+//区块连接到链上时写入区块中每笔交易涉及的地址，被花费的输出从区块的撤销记录中得到
+func (idx *AddrIndex) ConnectBlock(tx *bolt.Tx,b *block.Block,height int) error {
+	undo,err := blockchain.ReadBlockUndo(tx,b.Hash)
+	if err != nil {
+		return err
+	}
+	spent := make(map[string]transaction.TXOutput)
+	for _,s := range undo.Spent {
+		spent[string(blockchain.OutpointKey(s.Txid,s.Vout))] = s.Output
+	}
+	resolve := func(txid []byte,vout int) (transaction.TXOutput,bool) {
+		out,ok := spent[string(blockchain.OutpointKey(txid,vout))]
+		return out,ok
+	}
+	return putBlock(tx,b,height,resolve)
+}
+
+//区块从链上断开时删除区块写入的记录
+func (idx *AddrIndex) DisconnectBlock(tx *bolt.Tx,b *block.Block,height int) error {
+	bucket,err := tx.CreateBucketIfNotExists([]byte(indexBucket))
+	if err != nil {
+		return err
+	}
+	for _,t := range b.Transactions {
+		for pubKeyHash := range changes(t,nil) {
+			err = bucket.Delete(entryKey([]byte(pubKeyHash),height,t.ID))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return setBest(tx,b.PrevBlockHash)
+}
+
+//让索引和区块链的顶端保持一致，在注册到区块链之前调用。
+//索引是新启用的，或者停用期间有区块连接到链上时，从创世区块开始重建索引
+func (idx *AddrIndex) Sync(bc *blockchain.Blockchain) error {
+	upToDate := false
+	err := bc.Db().View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte(metaBucket))
+		upToDate = meta != nil && tx.Bucket([]byte(indexBucket)) != nil &&
+			bytes.Equal(meta.Get(bestBlockKey),bc.Tip())
+		return nil
+	})
+	if err != nil || upToDate {
+		return err
+	}
+	return idx.Reindex(bc)
+}
+
+//从创世区块开始重建索引，调用期间不能有区块连接到链上
+func (idx *AddrIndex) Reindex(bc *blockchain.Blockchain) error {
+	//从顶端往回收集区块哈希，之后从创世区块开始按顺序写入
+	var hashes [][]byte
+	bci := bc.Iterator()
+	for {
+		b,err := bci.Next()
+		if err != nil {
+			return err
+		}
+		hashes = append(hashes,b.Hash)
+		if len(b.PrevBlockHash) == 0 {
+			break
+		}
+	}
+
+	return bc.Db().Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket([]byte(indexBucket))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		//链上所有出现过的输出，用于得到交易输入花费的金额
+		outputs := make(map[string]transaction.TXOutput)
+		resolve := func(txid []byte,vout int) (transaction.TXOutput,bool) {
+			out,ok := outputs[string(blockchain.OutpointKey(txid,vout))]
+			return out,ok
+		}
+		for height := 0; height < len(hashes); height++ {
+			b,err := blockchain.ReadBlock(tx,hashes[len(hashes)-1-height])
+			if err != nil {
+				return err
+			}
+			err = putBlock(tx,b,height,resolve)
+			if err != nil {
+				return err
+			}
+			for _,t := range b.Transactions {
+				for outIdx,out := range t.Vout {
+					outputs[string(blockchain.OutpointKey(t.ID,outIdx))] = out
+				}
+			}
+		}
+		return nil
+	})
+}
+
+//返回地址address的交易记录，最新的在前，跳过最新的skip条后最多返回count条。
+//地址无效时返回wallet.ErrInvalidAddress，否则前缀查找会匹配到其他地址的记录
+func (idx *AddrIndex) Transactions(bc *blockchain.Blockchain,address string,count,skip int) ([]Entry,error) {
+	if !wallet.ValidateAddress(address) {
+		return nil,wallet.ErrInvalidAddress
+	}
+	pubKeyHash := wallet.AddressPubKeyHash(address)
+	var entries []Entry
+	err := bc.Db().View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(indexBucket))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		//定位到该地址最后一条记录，所有键都小于 公钥哈希 + 全0xff
+		upper := append(append([]byte{},pubKeyHash...),bytes.Repeat([]byte{0xff},9)...)
+		k,v := c.Seek(upper)
+		if k == nil {
+			k,v = c.Last()
+		} else {
+			k,v = c.Prev()
+		}
+		for ; k != nil && bytes.HasPrefix(k,pubKeyHash) && len(entries) < count; k,v = c.Prev() {
+			if skip > 0 {
+				skip--
+				continue
+			}
+			var value entryValue
+			err := gob.NewDecoder(bytes.NewReader(v)).Decode(&value)
+			if err != nil {
+				return err
+			}
+			rest := k[len(pubKeyHash):]
+			entries = append(entries,Entry{
+				TxID:      append([]byte{},rest[8:]...),
+				Height:    int(binary.BigEndian.Uint64(rest[:8])),
+				BlockHash: value.BlockHash,
+				Received:  value.Received,
+				Sent:      value.Sent,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil,err
+	}
+	return entries,nil
+}
+
+//写入区块中每笔交易对各个地址的影响，resolve返回交易输入引用的输出
+func putBlock(tx *bolt.Tx,b *block.Block,height int,resolve func(txid []byte,vout int) (transaction.TXOutput,bool)) error {
+	bucket,err := tx.CreateBucketIfNotExists([]byte(indexBucket))
+	if err != nil {
+		return err
+	}
+	for _,t := range b.Transactions {
+		for pubKeyHash,value := range changes(t,resolve) {
+			value.BlockHash = b.Hash
+			var buff bytes.Buffer
+			err = gob.NewEncoder(&buff).Encode(value)
+			if err != nil {
+				return err
+			}
+			err = bucket.Put(entryKey([]byte(pubKeyHash),height,t.ID),buff.Bytes())
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return setBest(tx,b.Hash)
+}
+
+//计算交易对每个相关地址的影响，键为公钥哈希。
+//resolve为nil时只找出相关的地址，不计算花费的金额
+func changes(t *transaction.Transaction,resolve func(txid []byte,vout int) (transaction.TXOutput,bool)) map[string]*entryValue {
+	result := make(map[string]*entryValue)
+	get := func(pubKeyHash []byte) *entryValue {
+		value,ok := result[string(pubKeyHash)]
+		if !ok {
+			value = &entryValue{}
+			result[string(pubKeyHash)] = value
+		}
+		return value
+	}
+	if !t.IsCoinbase() {
+		for _,vin := range t.Vin {
+			if resolve != nil {
+				if out,ok := resolve(vin.Txid,vin.Vout); ok {
+					get(out.PubkeyHash).Sent += out.Value
+					continue
+				}
+			}
+			get(wallet.HashPubKey(vin.PubKey))
+		}
+	}
+	for _,out := range t.Vout {
+		get(out.PubkeyHash).Received += out.Value
+	}
+	return result
+}
+
+//索引中的键：公钥哈希 + 8字节大端序的高度 + 交易ID
+func entryKey(pubKeyHash []byte,height int,txid []byte) []byte {
+	key := make([]byte,len(pubKeyHash)+8,len(pubKeyHash)+8+len(txid))
+	copy(key,pubKeyHash)
+	binary.BigEndian.PutUint64(key[len(pubKeyHash):],uint64(height))
+	return append(key,txid...)
+}
+
+//记录索引所反映的顶端区块
+func setBest(tx *bolt.Tx,hash []byte) error {
+	meta,err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+	if err != nil {
+		return err
+	}
+	return meta.Put(bestBlockKey,hash)
+}
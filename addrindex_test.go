@@ -0,0 +1,64 @@
+package addrindex
+
+import (
+	"crypto/sha256"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"go_code/A_golang_blockchain/base58"
+	"go_code/A_golang_blockchain/blockchain"
+	"go_code/A_golang_blockchain/chaincfg"
+	"go_code/A_golang_blockchain/consensus"
+	"go_code/A_golang_blockchain/wallet"
+)
+
+//用payload编码一个校验位正确的地址，payload不一定是完整的公钥哈希
+func encodeAddress(payload []byte) string {
+	versioned := append([]byte{chaincfg.ActiveNetParams.AddressVersion}, payload...)
+	first := sha256.Sum256(versioned)
+	second := sha256.Sum256(first[:])
+	return string(base58.Base58Encode(append(versioned, second[:4]...)))
+}
+
+//无效地址不会按前缀匹配到其他地址的记录
+func TestTransactionsValidatesAddress(t *testing.T) {
+	if err := chaincfg.SetActiveNet("regtest"); err != nil {
+		t.Fatal(err)
+	}
+	ws := &wallet.Wallets{Wallets: map[string]*wallet.Wallet{}}
+	addr, err := ws.CreateWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc, err := blockchain.CreateBlockchain(filepath.Join(t.TempDir(), "chain.db"), addr, consensus.NewDev())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Db().Close()
+	idx := NewAddrIndex()
+	if err := idx.Sync(bc); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := idx.Transactions(bc, addr, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("entries for the genesis address = %d, want 1", len(entries))
+	}
+
+	pubKeyHash := wallet.AddressPubKeyHash(addr)
+	for _, bad := range []string{
+		"",
+		"not an address",
+		addr[:len(addr)-1],
+		encodeAddress(nil),
+		encodeAddress(pubKeyHash[:4]),
+	} {
+		if _, err := idx.Transactions(bc, bad, 10, 0); !errors.Is(err, wallet.ErrInvalidAddress) {
+			t.Errorf("Transactions(%q) = %v, want %v", bad, err, wallet.ErrInvalidAddress)
+		}
+	}
+}
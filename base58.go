@@ -18,7 +18,8 @@ func Base58Encode(input []byte) []byte {
 		result = append(result, b58Alphabet[mod.Int64()])
 	}
 	ReverseBytes(result)
-	for b := range input {
+	//每个前导的0x00字节编码为一个字符'1'
+	for _, b := range input {
 		if b == 0x00 {
 			result = append([]byte{b58Alphabet[0]}, result...)
 		} else {
@@ -32,9 +33,12 @@ func Base58Encode(input []byte) []byte {
 func Base58Decode(input []byte) []byte {
 	result := big.NewInt(0)
 	zeroBytes := 0
-	for b := range input {
-		if b == 0x00 {
+	//每个前导的字符'1'解码为一个0x00字节
+	for _, b := range input {
+		if b == b58Alphabet[0] {
 			zeroBytes++
+		} else {
+			break
 		}
 	}
 	payload := input[zeroBytes:]
@@ -1,10 +1,11 @@
 package block
 
 import (
-	_"crypto/sha256"
+	"crypto/sha256"
 	"encoding/gob"
 	"bytes"
-	"log"
+	"strconv"
+	"time"
 	"go_code/A_golang_blockchain/transaction"
 	"go_code/A_golang_blockchain/merkle_tree"
 )
@@ -15,9 +16,16 @@ type Block struct {
 	PrevBlockHash	[]byte
 	Hash 			[]byte
 	Nonce			int
+	Signer			[]byte //权威证明(PoA)中签署区块的公钥，工作量证明中为空
+	Signature		[]byte //签署者对区块哈希的签名
 }
 
-//区块交易字段的哈希
+//实例化一个还没有被封装(seal)的区块，由共识引擎计算区块哈希
+func NewBlock(transactions []*transaction.Transaction,prevBlockHash []byte) *Block {
+	return &Block{Timestamp: time.Now().Unix(),Transactions: transactions,PrevBlockHash: prevBlockHash,Hash: []byte{}}
+}
+
+//区块交易字段的哈希：交易ID(不包含签名和公钥)的默克尔根
 func (b *Block) HashTransactions() []byte {
 	//var txHash [32]byte
 	//var txHashes [][]byte
@@ -25,7 +33,7 @@ func (b *Block) HashTransactions() []byte {
 
 	for _,tx := range b.Transactions {
 		//txHashes = append(txHashes,tx.Hash())
-		transactions = append(transactions,tx.Serialize())
+		transactions = append(transactions,tx.TxID())
 	}
 	//txHash = sha256.Sum256(bytes.Join(txHashes,[]byte{}))
 	mTree := merkle_tree.NewMerkleTree(transactions)
@@ -34,27 +42,53 @@ func (b *Block) HashTransactions() []byte {
 	return mTree.RootNode.Data
 }
 
+//交易见证哈希的默克尔根，和交易ID的默克尔根一起放进区块头，区块哈希因此也覆盖交易的签名和公钥，
+//改动区块中任何一笔交易的签名都会改变区块哈希
+func (b *Block) HashWitnesses() []byte {
+	var witnesses [][]byte
+	for _,tx := range b.Transactions {
+		witnesses = append(witnesses,tx.WitnessHash())
+	}
+	mTree := merkle_tree.NewMerkleTree(witnesses)
+	return mTree.RootNode.Data
+}
+
+//区块头的哈希，不包含nonce和签名，用于不需要工作量证明的共识引擎
+func (b *Block) SealHash() []byte {
+	data := bytes.Join(
+		[][]byte{
+			b.PrevBlockHash,
+			b.HashTransactions(),
+			b.HashWitnesses(),
+			[]byte(strconv.FormatInt(b.Timestamp,10)),
+		},
+		[]byte{},
+	)
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
+
 //0.3 实现Block的序列化
 func (b *Block) Serialize() []byte {
 	//首先定义一个buffer存储序列化后的数据
 	var result bytes.Buffer
 	//实例化一个序列化实例,结果保存到result中
 	encoder := gob.NewEncoder(&result)
-	//对区块进行实例化
+	//对区块进行实例化，编码固定的结构体不会失败，失败说明是程序错误
 	err := encoder.Encode(b)
 	if err != nil {
-		log.Panic(err)
+		panic(err)
 	}
 	return result.Bytes()
 }
 
 //0.3 实现反序列化函数
-func DeserializeBlock(d []byte) *Block {
+func DeserializeBlock(d []byte) (*Block,error) {
 	var block Block
 	decoder := gob.NewDecoder(bytes.NewReader(d))
 	err := decoder.Decode(&block)
 	if err != nil {
-		log.Panic(err)
+		return nil,err
 	}
-	return &block
+	return &block,nil
 }
@@ -1,30 +1,216 @@
 package blockchain
 
 import (
-	"os"
+	"context"
 	"bytes"
-	"crypto/ecdsa"
+	"encoding/binary"
+	"encoding/gob"
 	"encoding/hex"
 	"fmt"
 	"github.com/boltdb/bolt"
 	"go_code/A_golang_blockchain/block"
-	"go_code/A_golang_blockchain/pow"
+	"go_code/A_golang_blockchain/chaincfg"
+	"go_code/A_golang_blockchain/consensus"
 	"go_code/A_golang_blockchain/transaction"
-	
-
-	"log"
+	"go_code/A_golang_blockchain/wallet"
 	"errors"
+	"runtime"
+	"sync"
+	"time"
 )
 /*
 	区块链实现
 */
-const dbFile = "blockchain.db"
-const blocksBucket = "blocks"
-const genesisCoinbaseData = "The Times 03/Jan/2009 Chancellor on brink of second bailout for banks"
-//区块链
+//创世区块信息由当前网络参数chaincfg.ActiveNetParams决定，数据库文件路径由调用者传入
+const (
+	blocksBucket = "blocks"
+	//UTXO集所在的桶，和区块在同一个数据库事务中更新。
+	//键为OutpointKey(交易ID,输出序号)，值为序列化后的UTXOEntry
+	UTXOBucket = "chainstate"
+	//UTXO集按公钥哈希的索引，键为公钥哈希+OutpointKey，值为空
+	UTXOAddrBucket = "chainstate_addr"
+	//UTXO集的元数据，键bestBlockKey对应UTXO集所反映的顶端区块哈希
+	chainstateMetaBucket = "chainstate_meta"
+	//高度索引，区块高度对应区块哈希
+	heightBucket = "heights"
+	//区块哈希对应区块高度
+	blockHeightBucket = "blockheights"
+	//区块哈希对应区块的撤销记录，用于把区块从链上断开
+	undoBucket = "undo"
+	//被invalidateblock标记为无效的区块哈希，对应标记时链顶端的哈希
+	invalidBucket = "invalid"
+)
+
+var (
+	bestBlockKey = []byte("best")
+	versionKey = []byte("version")
+)
+
+//UTXO集的存储格式版本，数据库中的版本不同时启动时会重建UTXO集
+const chainstateVersion = 3
+
+//区块的存储格式版本，保存在区块桶的versionKey下。
+//版本2的交易ID不包含签名和公钥，区块头提交见证数据的默克尔根，旧版本的区块无法验证，也不能原地转换
+const chainVersion = 2
+
+//打开数据库时等待其他进程释放文件锁的最长时间。
+//bolt在一个进程打开数据库期间锁住整个文件，例如mine运行时其他命令无法打开数据库
+const dbOpenTimeout = time.Second
+
+//UTXO集中一个输出的键：交易ID后接4字节大端序的输出序号，
+//输出序号就是TXInput.Vout引用的原始序号，不会因为同一交易的其他输出被花费而改变
+func OutpointKey(txid []byte,vout int) []byte {
+	key := make([]byte,len(txid)+4)
+	copy(key,txid)
+	binary.BigEndian.PutUint32(key[len(txid):],uint32(vout))
+	return key
+}
+
+//从OutpointKey中解析出交易ID和输出序号
+func ParseOutpointKey(key []byte) ([]byte,int) {
+	n := len(key)-4
+	return append([]byte{},key[:n]...),int(binary.BigEndian.Uint32(key[n:]))
+}
+
+var (
+	//数据库中没有区块链，需要先创建
+	ErrChainNotFound = errors.New("no existing blockchain found, create one first")
+	//数据库中已经存在区块链
+	ErrChainExists = errors.New("blockchain already exists")
+	//链上找不到该交易
+	ErrTxNotFound = errors.New("transaction is not found")
+	//交易签名验证失败
+	ErrInvalidTx = errors.New("invalid transaction")
+	//挖矿期间链的顶端已经被其他区块更新，挖出的区块作废；或者要连接的区块不是接在当前顶端之后
+	ErrStaleTip = errors.New("block does not extend the current chain tip")
+	//数据库中找不到该区块
+	ErrBlockNotFound = errors.New("block is not found")
+	//区块中的交易花费了还没有成熟的coinbase输出
+	ErrImmatureSpend = errors.New("tried to spend immature coinbase output")
+	//交易输出的金额之和大于引用的输出的金额之和
+	ErrNegativeFee = errors.New("transaction outputs exceed its inputs")
+	//区块的第一笔交易不是coinbase，或者后面还有其他coinbase交易
+	ErrBadCoinbasePosition = errors.New("block must have exactly one coinbase transaction, as its first transaction")
+	//coinbase交易的输出大于挖矿奖励加上区块中交易的手续费
+	ErrBadCoinbaseValue = errors.New("coinbase pays more than the subsidy plus fees")
+	//区块的封装(工作量证明或签名)验证失败
+	ErrInvalidSeal = errors.New("block seal is not valid")
+	//区块已经被标记为无效
+	ErrInvalidBlock = errors.New("block is marked invalid")
+	//没有区块的撤销记录，例如区块是在撤销记录出现之前连接的
+	ErrNoUndoData = errors.New("no undo data for block")
+	//创世区块不能从链上断开
+	ErrDisconnectGenesis = errors.New("cannot disconnect the genesis block")
+	//区块没有被标记为无效
+	ErrNotInvalidated = errors.New("block is not marked invalid")
+	//标记无效之后链上又加入了新的区块，无法再接回原来的区块
+	ErrTipMoved = errors.New("chain has advanced since the block was invalidated")
+	//数据库中的区块是旧版本的存储格式创建的，需要删除数据库重新创建区块链
+	ErrOldChainFormat = errors.New("blockchain database uses an old block format, delete it and create a new blockchain")
+	//数据库被另一个进程打开，例如正在运行的mine命令
+	ErrDatabaseLocked = errors.New("blockchain database is locked by another process")
+)
+
+//打开数据库文件，文件被另一个进程锁住超过dbOpenTimeout时返回ErrDatabaseLocked，不会一直等待
+func openDB(dbFile string) (*bolt.DB,error) {
+	db,err := bolt.Open(dbFile,0600,&bolt.Options{Timeout: dbOpenTimeout})
+	if err == bolt.ErrTimeout {
+		return nil,fmt.Errorf("%w: %s",ErrDatabaseLocked,dbFile)
+	}
+	return db,err
+}
+
+//可选的索引，区块连接到链上或者从链上断开时和区块、UTXO集在同一个数据库事务中更新，
+//任何一个索引返回错误，整个操作都不会被写入
+type Indexer interface {
+	//height为区块在链上的高度，创世区块为0。索引需要的桶由索引自己创建
+	ConnectBlock(tx *bolt.Tx,b *block.Block,height int) error
+	//撤销ConnectBlock对索引的修改
+	DisconnectBlock(tx *bolt.Tx,b *block.Block,height int) error
+}
+
+//被区块花费掉的一个输出，Txid和Vout为区块中交易输入引用的位置，
+//Height和Coinbase为创建该输出的交易所在的区块高度以及是否为coinbase交易
+type SpentOutput struct {
+	Txid		[]byte
+	Vout		int
+	Output		transaction.TXOutput
+	Height		int
+	Coinbase	bool
+}
+
+//UTXO集中的一个条目：未花费的输出，以及创建它的交易所在的区块高度、是否为coinbase交易
+type UTXOEntry struct {
+	Output		transaction.TXOutput
+	Height		int
+	Coinbase	bool
+}
+
+//序列化UTXO条目，UTXOEntry中只有可编码的字段，编码失败属于程序错误
+func (e UTXOEntry) Serialize() []byte {
+	var buff bytes.Buffer
+
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(e)
+	if err != nil {
+		panic(err)
+	}
+	return buff.Bytes()
+}
+
+//反序列化UTXO条目
+func DeserializeUTXOEntry(data []byte) (UTXOEntry,error) {
+	var entry UTXOEntry
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&entry)
+
+	return entry,err
+}
+
+//高度为height的区块中的交易能否花费entry：coinbase输出要经过CoinbaseMaturity个区块之后才能花费
+func (e UTXOEntry) IsMature(height int) bool {
+	return !e.Coinbase || height-e.Height >= chaincfg.ActiveNetParams.CoinbaseMaturity
+}
+
+//区块的撤销记录，按区块中交易和输入的顺序保存被花费掉的输出
+type BlockUndo struct {
+	Spent []SpentOutput
+}
+
+//序列化撤销记录，BlockUndo中只有可编码的字段，编码失败属于程序错误
+func (u BlockUndo) Serialize() []byte {
+	var buff bytes.Buffer
+
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(u)
+	if err != nil {
+		panic(err)
+	}
+	return buff.Bytes()
+}
+
+//反序列化撤销记录
+func DeserializeBlockUndo(data []byte) (BlockUndo,error) {
+	var undo BlockUndo
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&undo)
+
+	return undo,err
+}
+//区块链，可以被多个协程同时使用：读操作可以并发进行，写操作(改变链的顶端)同一时间只有一个
 type Blockchain struct {
 	tip		[]byte
 	db 		*bolt.DB
+	engine	consensus.Engine //封装和验证区块使用的共识引擎
+
+	mu			sync.RWMutex //保护tip、engine和subscribers
+	writeMu		sync.Mutex   //保证同一时间只有一个写者
+	subscribers	map[int]chan []byte //订阅了顶端变化的通道
+	nextSubID	int
+	indexers	[]Indexer //随区块一起更新的可选索引
+	sigCache	*wallet.SigCache //验证通过的签名，交易池和区块验证共用
 }
 
 //工厂模式db
@@ -32,130 +218,1037 @@ func(bc *Blockchain) Db() *bolt.DB {
 	return bc.db
 }
 
-//把区块添加进区块链,挖矿
-func (bc *Blockchain) MineBlock(transactions []*transaction.Transaction) *block.Block {
+//返回链顶端区块的哈希
+func (bc *Blockchain) Tip() []byte {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.tip
+}
+
+//返回区块链使用的共识引擎
+func (bc *Blockchain) Engine() consensus.Engine {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.engine
+}
+
+//更换共识引擎，默认为工作量证明
+func (bc *Blockchain) SetEngine(engine consensus.Engine) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.engine = engine
+}
+
+//注册一个可选索引，之后连接的每个区块都会同时更新该索引
+func (bc *Blockchain) AddIndexer(idx Indexer) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.indexers = append(bc.indexers,idx)
+}
+
+//订阅链顶端的变化，每当有新的区块成为顶端时，通道中会收到新顶端的哈希。
+//接收不及时的订阅者只会收到最新的顶端，调用返回的函数取消订阅
+func (bc *Blockchain) SubscribeTip() (<-chan []byte,func()) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	if bc.subscribers == nil {
+		bc.subscribers = make(map[int]chan []byte)
+	}
+	id := bc.nextSubID
+	bc.nextSubID++
+	ch := make(chan []byte,1)
+	bc.subscribers[id] = ch
+
+	var once sync.Once
+	return ch,func() {
+		once.Do(func() {
+			bc.mu.Lock()
+			defer bc.mu.Unlock()
+			delete(bc.subscribers,id)
+			close(ch)
+		})
+	}
+}
+
+//更新链的顶端并通知订阅者，调用者必须持有writeMu
+func (bc *Blockchain) setTip(hash []byte) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.tip = hash
+	for _,ch := range bc.subscribers {
+		//丢弃还没有被取走的旧顶端，只保留最新的
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- hash
+	}
+}
+
+//把区块添加进区块链,挖矿,由共识引擎封装区块。
+//区块、顶端指针和UTXO集的变化在同一个数据库事务中写入。
+//ctx被取消时返回ctx.Err()，挖矿期间顶端区块发生变化时返回ErrStaleTip
+func (bc *Blockchain) MineBlock(ctx context.Context,transactions []*transaction.Transaction) (*block.Block,error) {
 	var lastHash []byte
 
 	//在一笔交易被放入一个块之前进行验证
-	for _, tx := range transactions {
-		if bc.VerifyTransaction(tx) != true {
-			log.Panic("ERROR: 无效 transaction")
-		}
+	err := bc.verifyTransactions(transactions)
+	if err != nil {
+		return nil,err
 	}
 	//只读的方式浏览数据库，获取当前区块链顶端区块的哈希，为加入下一区块做准备
-	err := bc.db.View(func(tx *bolt.Tx) error {
+	err = bc.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		lastHash = b.Get([]byte("l"))	//通过键"l"拿到区块链顶端区块哈希
+		//通过键"l"拿到区块链顶端区块哈希，Get返回的数据只在事务内有效，需要复制出来
+		lastHash = append([]byte{},b.Get([]byte("l"))...)
 
 		return nil
 	})
 	if err != nil {
-		log.Panic(err)
+		return nil,err
 	}
 
 	//prevBlock := bc.Blocks[len(bc.Blocks)-1]
 	//求出新区块
-	newBlock := pow.NewBlock(transactions,lastHash)
+	newBlock := block.NewBlock(transactions,lastHash)
+	err = bc.Engine().Seal(ctx,newBlock)
+	if err != nil {
+		return nil,err
+	}
 	// bc.Blocks = append(bc.Blocks,newBlock)
-	//把新区块加入到数据库区块链中
-	err = bc.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		err := b.Put(newBlock.Hash,newBlock.Serialize())
+	//把新区块加入到数据库区块链中，交易已经验证过，不需要再验证一次
+	err = bc.connect(newBlock)
+	if err != nil {
+		return nil,err
+	}
+
+	return newBlock,nil
+}
+
+//把一个已经封装好的区块连接到链的顶端，例如从其他节点收到的区块。
+//先验证区块的封装和其中的交易，再把区块、顶端指针、UTXO集的变化和索引在同一个数据库事务中写入，
+//中途失败或者进程崩溃都不会留下只写了一半的状态
+func (bc *Blockchain) ConnectBlock(b *block.Block) error {
+	//先检查区块的结构，没有交易的区块无法计算封装用的哈希
+	err := checkCoinbase(b.Transactions)
+	if err != nil {
+		return err
+	}
+	if !bc.Engine().VerifySeal(b) {
+		return fmt.Errorf("%w: %x",ErrInvalidSeal,b.Hash)
+	}
+	err = bc.verifyTransactions(b.Transactions)
+	if err != nil {
+		return err
+	}
+	return bc.connect(b)
+}
+
+//验证区块中coinbase的位置、所有交易的ID，以及除coinbase以外的交易签名。输入引用的输出在一个只读事务中从UTXO集取出，
+//也可以是区块中排在前面的交易创建的输出，再用verifySignatures并行验证
+func (bc *Blockchain) verifyTransactions(transactions []*transaction.Transaction) error {
+	err := checkCoinbase(transactions)
+	if err != nil {
+		return err
+	}
+	err = checkTxIDs(transactions)
+	if err != nil {
+		return err
+	}
+	var jobs []sigJob
+	created := make(map[string]transaction.TXOutput)
+	err = bc.db.View(func(btx *bolt.Tx) error {
+		utxos := btx.Bucket([]byte(UTXOBucket))
+		for _,tx := range transactions {
+			if !tx.IsCoinbase() {
+				outs,err := prevOutputs(utxos,tx,created)
+				if err != nil {
+					return err
+				}
+				jobs = append(jobs,sigJob{tx,outs})
+			}
+			for outIdx,out := range tx.Vout {
+				created[string(OutpointKey(tx.ID,outIdx))] = out
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return verifySignatures(jobs,bc.sigCache)
+}
+
+//检查区块中只有第一笔交易是coinbase，否则返回ErrBadCoinbasePosition。
+//没有交易的区块也无效，它的默克尔根无法计算
+func checkCoinbase(transactions []*transaction.Transaction) error {
+	if len(transactions) == 0 {
+		return fmt.Errorf("%w: block has no transactions",ErrBadCoinbasePosition)
+	}
+	for i,tx := range transactions {
+		if tx.IsCoinbase() != (i == 0) {
+			return fmt.Errorf("%w: transaction %d %x",ErrBadCoinbasePosition,i,tx.ID)
+		}
+	}
+	return nil
+}
+
+//检查区块中每笔交易的ID都是由交易内容算出的TxID，并且没有重复。
+//默克尔树在某一层节点为单数时复制最后一个，交易列表末尾重复的交易不会改变默克尔根，所以必须拒绝重复的ID
+func checkTxIDs(transactions []*transaction.Transaction) error {
+	seen := make(map[string]bool,len(transactions))
+	for _,tx := range transactions {
+		if !bytes.Equal(tx.ID,tx.TxID()) {
+			return fmt.Errorf("%w %x: id does not match its contents",ErrInvalidTx,tx.ID)
+		}
+		if seen[string(tx.ID)] {
+			return fmt.Errorf("%w %x: duplicate transaction",ErrInvalidTx,tx.ID)
+		}
+		seen[string(tx.ID)] = true
+	}
+	return nil
+}
+
+//一笔交易和它的各输入引用的输出
+type sigJob struct {
+	tx			*transaction.Transaction
+	prevOuts	[]transaction.TXOutput
+}
+
+//每个协程至少验证这么多签名，签名太少时分给多个协程得不偿失
+const minSigsPerWorker = 8
+
+//并行验证交易签名：按输入数把交易平均分成GOMAXPROCS份(默认为CPU核心数，同一笔交易不会被拆开)，
+//每份的签名加入一个wallet.BatchVerifier一起验证。cache不为nil时，缓存中的签名跳过，
+//验证通过的签名加入缓存。有无效的交易时返回ErrInvalidTx，多笔交易无效时指出排在最前面的一笔
+func verifySignatures(jobs []sigJob,cache *wallet.SigCache) error {
+	total := 0
+	for _,job := range jobs {
+		total += len(job.prevOuts)
+	}
+	workers := runtime.GOMAXPROCS(0)
+	if n := (total+minSigsPerWorker-1)/minSigsPerWorker; n < workers {
+		workers = n
+	}
+	if workers <= 1 {
+		return verifyChunk(jobs,cache)
+	}
+
+	per := (total+workers-1)/workers
+	var chunks [][]sigJob
+	start,count := 0,0
+	for i,job := range jobs {
+		count += len(job.prevOuts)
+		if count >= per || i == len(jobs)-1 {
+			chunks = append(chunks,jobs[start:i+1])
+			start,count = i+1,0
+		}
+	}
+	errs := make([]error,len(chunks))
+	var wg sync.WaitGroup
+	for i,chunk := range chunks {
+		wg.Add(1)
+		go func(i int,chunk []sigJob) {
+			defer wg.Done()
+			errs[i] = verifyChunk(chunk,cache)
+		}(i,chunk)
+	}
+	wg.Wait()
+	for _,err := range errs {
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
-		err = b.Put([]byte("l"),newBlock.Hash)
-		bc.tip = newBlock.Hash
+	}
+	return nil
+}
 
+//在当前协程中批量验证jobs，批量验证失败时再逐个验证，找出无效的交易
+func verifyChunk(jobs []sigJob,cache *wallet.SigCache) error {
+	bv := wallet.NewBatchVerifier(cache)
+	for _,job := range jobs {
+		if !job.tx.AddToBatch(bv,job.prevOuts) {
+			return fmt.Errorf("%w %x",ErrInvalidTx,job.tx.ID)
+		}
+	}
+	if bv.Verify() {
+		return nil
+	}
+	for _,job := range jobs {
+		if !job.tx.VerifyPrevOuts(job.prevOuts) {
+			return fmt.Errorf("%w %x",ErrInvalidTx,job.tx.ID)
+		}
+	}
+	return ErrInvalidTx
+}
+
+//VerifyChain每攒够这么多签名就验证一次，不需要把整条链放在内存中
+const verifyChainBatch = 4096
+
+//从创世区块开始重新验证链上所有交易的ID和签名，例如重建UTXO集之前检查数据库中的区块。
+//输入引用的输出从之前的区块创建的输出中查找，找不到时返回ErrTxNotFound；签名用verifySignatures并行验证
+func (bc *Blockchain) VerifyChain() error {
+	var hashes [][]byte
+	bci := bc.Iterator()
+	for {
+		b,err := bci.Next()
+		if err != nil {
+			return err
+		}
+		hashes = append(hashes,b.Hash)
+		if len(b.PrevBlockHash) == 0 {
+			break
+		}
+	}
+
+	outputs := make(map[string]transaction.TXOutput)
+	var jobs []sigJob
+	pending := 0
+	for i := len(hashes)-1; i >= 0; i-- {
+		b,err := bc.GetBlock(hashes[i])
+		if err != nil {
+			return err
+		}
+		err = checkCoinbase(b.Transactions)
+		if err != nil {
+			return err
+		}
+		err = checkTxIDs(b.Transactions)
+		if err != nil {
+			return err
+		}
+		for _,tx := range b.Transactions {
+			if !tx.IsCoinbase() {
+				outs := make([]transaction.TXOutput,len(tx.Vin))
+				for inID,vin := range tx.Vin {
+					key := string(OutpointKey(vin.Txid,vin.Vout))
+					out,ok := outputs[key]
+					if !ok {
+						return fmt.Errorf("%w: output %x:%d spent in block %x",ErrTxNotFound,vin.Txid,vin.Vout,b.Hash)
+					}
+					outs[inID] = out
+					delete(outputs,key)
+				}
+				jobs = append(jobs,sigJob{tx,outs})
+				pending += len(outs)
+			}
+			for outIdx,out := range tx.Vout {
+				outputs[string(OutpointKey(tx.ID,outIdx))] = out
+			}
+		}
+		if pending >= verifyChainBatch {
+			err = verifySignatures(jobs,nil)
+			if err != nil {
+				return err
+			}
+			jobs,pending = nil,0
+		}
+	}
+	return verifySignatures(jobs,nil)
+}
+
+//找出交易各输入引用的输出：先在pending(同一区块中前面的交易创建的输出)中找，再在UTXO集中找，
+//都找不到时返回ErrTxNotFound
+func prevOutputs(utxos *bolt.Bucket,tx *transaction.Transaction,pending map[string]transaction.TXOutput) ([]transaction.TXOutput,error) {
+	outs := make([]transaction.TXOutput,len(tx.Vin))
+	for inID,vin := range tx.Vin {
+		key := OutpointKey(vin.Txid,vin.Vout)
+		if out,ok := pending[string(key)]; ok {
+			outs[inID] = out
+			continue
+		}
+		data := utxos.Get(key)
+		if data == nil {
+			return nil,fmt.Errorf("%w: output %x:%d is not in the UTXO set",ErrTxNotFound,vin.Txid,vin.Vout)
+		}
+		entry,err := DeserializeUTXOEntry(data)
+		if err != nil {
+			return nil,err
+		}
+		outs[inID] = entry.Output
+	}
+	return outs,nil
+}
+
+//在一个读写事务中写入区块和索引并更新顶端
+func (bc *Blockchain) connect(b *block.Block) error {
+	return bc.update(func(tx *bolt.Tx,indexers []Indexer) error {
+		height,err := connectBlock(tx,b)
+		if err != nil {
+			return err
+		}
+		for _,idx := range indexers {
+			err = idx.ConnectBlock(tx,b,height)
+			if err != nil {
+				return err
+			}
+		}
 		return nil
 	})
+}
+
+//在数据库事务tx中把区块b接到链的顶端，写入区块、"l"、UTXO集的变化和高度索引，返回区块的高度。
+//b.PrevBlockHash为空时b是创世区块
+func connectBlock(tx *bolt.Tx,b *block.Block) (int,error) {
+	blocks := tx.Bucket([]byte(blocksBucket))
+	if tx.Bucket([]byte(invalidBucket)).Get(b.Hash) != nil {
+		return 0,fmt.Errorf("%w: %x",ErrInvalidBlock,b.Hash)
+	}
+	height := 0
+	if len(b.PrevBlockHash) > 0 {
+		//挖矿期间有新的区块成为了顶端，或者区块不是接在顶端之后
+		if !bytes.Equal(blocks.Get([]byte("l")),b.PrevBlockHash) {
+			return 0,ErrStaleTip
+		}
+		prevHeight := tx.Bucket([]byte(blockHeightBucket)).Get(b.PrevBlockHash)
+		if prevHeight == nil {
+			return 0,fmt.Errorf("%w: height of %x",ErrBlockNotFound,b.PrevBlockHash)
+		}
+		height = decodeHeight(prevHeight)+1
+	} else if blocks.Get([]byte("l")) != nil {
+		//已经有创世区块时，没有父区块的区块会覆盖顶端、高度索引和UTXO集
+		return 0,fmt.Errorf("%w: block %x has no parent",ErrChainExists,b.Hash)
+	}
+
+	err := blocks.Put(b.Hash,b.Serialize())
+	if err != nil {
+		return 0,err
+	}
+	err = blocks.Put([]byte("l"),b.Hash)
+	if err != nil {
+		return 0,err
+	}
+	undo,err := connectUTXO(tx,b,height)
+	if err != nil {
+		return 0,err
+	}
+	err = tx.Bucket([]byte(undoBucket)).Put(b.Hash,undo.Serialize())
 	if err != nil {
-		log.Panic(err)
+		return 0,err
 	}
+	err = putHeight(tx,b.Hash,height)
+	if err != nil {
+		return 0,err
+	}
+	err = tx.Bucket([]byte(chainstateMetaBucket)).Put(bestBlockKey,b.Hash)
+	if err != nil {
+		return 0,err
+	}
+	return height,nil
+}
 
-	return newBlock
+//当区块链中的区块增加后，同步更新UTXO集,这里引入的区块为新加入的区块，height为它的高度。
+//返回的撤销记录保存了被花费掉的输出，花费未成熟的coinbase输出时返回ErrImmatureSpend，
+//交易的输出多于输入时返回ErrNegativeFee，coinbase超出挖矿奖励加手续费时返回ErrBadCoinbaseValue，
+//只有第一笔交易是coinbase的区块才有效，否则返回ErrBadCoinbasePosition
+func connectUTXO(tx *bolt.Tx,newBlock *block.Block,height int) (BlockUndo,error) {
+	var undo BlockUndo
+	if err := checkCoinbase(newBlock.Transactions); err != nil {
+		return undo,err
+	}
+	utxos := tx.Bucket([]byte(UTXOBucket))
+	addrs := tx.Bucket([]byte(UTXOAddrBucket))
+	fees,coinbaseValue := 0,0
+	for _,t := range newBlock.Transactions {
+		if t.IsCoinbase() == false {
+			prevOuts := make([]transaction.TXOutput,0,len(t.Vin))
+			for _,vin := range t.Vin {
+				data := utxos.Get(OutpointKey(vin.Txid,vin.Vout))
+				if data == nil {
+					return undo,fmt.Errorf("output %x:%d is not in the UTXO set",vin.Txid,vin.Vout)
+				}
+				entry,err := DeserializeUTXOEntry(data)
+				if err != nil {
+					return undo,err
+				}
+				if !entry.IsMature(height) {
+					return undo,fmt.Errorf("%w %x:%d",ErrImmatureSpend,vin.Txid,vin.Vout)
+				}
+				undo.Spent = append(undo.Spent,SpentOutput{vin.Txid,vin.Vout,entry.Output,entry.Height,entry.Coinbase})
+				prevOuts = append(prevOuts,entry.Output)
+				err = removeOutput(utxos,addrs,vin.Txid,vin.Vout,entry.Output.PubkeyHash)
+				if err != nil {
+					return undo,err
+				}
+			}
+			fee := t.Fee(prevOuts)
+			if fee < 0 {
+				return undo,fmt.Errorf("%w: %x",ErrNegativeFee,t.ID)
+			}
+			fees += fee
+		} else {
+			for _,out := range t.Vout {
+				coinbaseValue += out.Value
+			}
+		}
+		for outIdx,out := range t.Vout {
+			err := addOutput(utxos,addrs,t.ID,outIdx,UTXOEntry{out,height,t.IsCoinbase()})
+			if err != nil {
+				return undo,err
+			}
+		}
+	}
+	if coinbaseValue > chaincfg.ActiveNetParams.Subsidy+fees {
+		return undo,fmt.Errorf("%w: %d > %d+%d",ErrBadCoinbaseValue,coinbaseValue,chaincfg.ActiveNetParams.Subsidy,fees)
+	}
+	return undo,nil
 }
 
-//创建创世区块  /修改/
-func NewGenesisBlock(coinbase *transaction.Transaction) *block.Block {
-	return pow.NewBlock([]*transaction.Transaction{coinbase},[]byte{})
+//撤销connectUTXO对UTXO集的修改：按相反的顺序删除区块中交易创建的输出，并放回被花费掉的输出
+func disconnectUTXO(tx *bolt.Tx,oldBlock *block.Block,undo BlockUndo) error {
+	utxos := tx.Bucket([]byte(UTXOBucket))
+	addrs := tx.Bucket([]byte(UTXOAddrBucket))
+	pos := len(undo.Spent)
+	for i := len(oldBlock.Transactions)-1; i >= 0; i-- {
+		t := oldBlock.Transactions[i]
+		for outIdx,out := range t.Vout {
+			err := removeOutput(utxos,addrs,t.ID,outIdx,out.PubkeyHash)
+			if err != nil {
+				return err
+			}
+		}
+		if t.IsCoinbase() {
+			continue
+		}
+		for j := len(t.Vin)-1; j >= 0; j-- {
+			pos--
+			if pos < 0 {
+				return fmt.Errorf("undo data of block %x is too short",oldBlock.Hash)
+			}
+			spent := undo.Spent[pos]
+			err := addOutput(utxos,addrs,spent.Txid,spent.Vout,UTXOEntry{spent.Output,spent.Height,spent.Coinbase})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if pos != 0 {
+		return fmt.Errorf("undo data of block %x does not match its transactions",oldBlock.Hash)
+	}
+	return nil
 }
 
-//创建区块链数据库
-func CreateBlockchain(address string) *Blockchain {
-	var tip []byte
-	//此时的创世区块就要包含交易coinbaseTx
-	cbtx := transaction.NewCoinbaseTX(address, genesisCoinbaseData)
-	genesis := NewGenesisBlock(cbtx)
-	
-	db,err := bolt.Open(dbFile,0600,nil)
+//把一个输出加入UTXO集和地址索引
+func addOutput(utxos,addrs *bolt.Bucket,txid []byte,vout int,entry UTXOEntry) error {
+	key := OutpointKey(txid,vout)
+	err := utxos.Put(key,entry.Serialize())
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
-	//读写操作数据库
-	err = db.Update(func(tx *bolt.Tx) error{
-		b := tx.Bucket([]byte(blocksBucket))
-		//查看名字为blocksBucket的Bucket是否存在
-		if b != nil {
-		fmt.Println("Blockchain 已经存在...")
-		os.Exit(1)
+	return addrs.Put(append(append([]byte{},entry.Output.PubkeyHash...),key...),[]byte{})
+}
+
+//把一个输出从UTXO集和地址索引中删除
+func removeOutput(utxos,addrs *bolt.Bucket,txid []byte,vout int,pubKeyHash []byte) error {
+	key := OutpointKey(txid,vout)
+	err := utxos.Delete(key)
+	if err != nil {
+		return err
+	}
+	return addrs.Delete(append(append([]byte{},pubKeyHash...),key...))
+}
+
+//在数据库事务tx中按哈希读取区块，区块不在数据库中时返回ErrBlockNotFound
+func ReadBlock(tx *bolt.Tx,hash []byte) (*block.Block,error) {
+	encodeBlock := tx.Bucket([]byte(blocksBucket)).Get(hash)
+	if encodeBlock == nil {
+		return nil,fmt.Errorf("%w: %x",ErrBlockNotFound,hash)
+	}
+	return block.DeserializeBlock(encodeBlock)
+}
+
+//在数据库事务tx中读取区块的撤销记录，索引可以用它得到区块花费掉的输出。
+//区块没有撤销记录时返回ErrNoUndoData
+func ReadBlockUndo(tx *bolt.Tx,hash []byte) (BlockUndo,error) {
+	data := tx.Bucket([]byte(undoBucket)).Get(hash)
+	if data == nil {
+		return BlockUndo{},fmt.Errorf("%w %x",ErrNoUndoData,hash)
+	}
+	return DeserializeBlockUndo(data)
+}
+
+//在数据库事务tx中把顶端区块从链上断开，UTXO集、"l"和高度索引恢复到该区块之前的状态，
+//返回被断开的区块和它的高度。区块本身仍保留在数据库中
+func disconnectTip(tx *bolt.Tx) (*block.Block,int,error) {
+	blocks := tx.Bucket([]byte(blocksBucket))
+	encodeBlock := blocks.Get(blocks.Get([]byte("l")))
+	if encodeBlock == nil {
+		return nil,0,ErrBlockNotFound
+	}
+	//反序列化得到的是数据的副本，之后的写操作不会影响它
+	b,err := block.DeserializeBlock(encodeBlock)
+	if err != nil {
+		return nil,0,err
+	}
+	if len(b.PrevBlockHash) == 0 {
+		return nil,0,ErrDisconnectGenesis
+	}
+	undo,err := ReadBlockUndo(tx,b.Hash)
+	if err != nil {
+		return nil,0,err
 	}
-	//否则，则重新创建
-	b, err := tx.CreateBucket([]byte(blocksBucket))
+	heightData := tx.Bucket([]byte(blockHeightBucket)).Get(b.Hash)
+	if heightData == nil {
+		return nil,0,fmt.Errorf("%w: height of %x",ErrBlockNotFound,b.Hash)
+	}
+	height := decodeHeight(heightData)
+
+	err = disconnectUTXO(tx,b,undo)
+	if err != nil {
+		return nil,0,err
+	}
+	err = blocks.Put([]byte("l"),b.PrevBlockHash)
+	if err != nil {
+		return nil,0,err
+	}
+	err = tx.Bucket([]byte(heightBucket)).Delete(encodeHeight(height))
+	if err != nil {
+		return nil,0,err
+	}
+	err = tx.Bucket([]byte(blockHeightBucket)).Delete(b.Hash)
+	if err != nil {
+		return nil,0,err
+	}
+	err = tx.Bucket([]byte(undoBucket)).Delete(b.Hash)
+	if err != nil {
+		return nil,0,err
+	}
+	err = tx.Bucket([]byte(chainstateMetaBucket)).Put(bestBlockKey,b.PrevBlockHash)
+	if err != nil {
+		return nil,0,err
+	}
+	return b,height,nil
+}
+
+//断开顶端区块，区块连同索引一起撤销
+func (bc *Blockchain) disconnect(tx *bolt.Tx,indexers []Indexer) (*block.Block,error) {
+	b,height,err := disconnectTip(tx)
+	if err != nil {
+		return nil,err
+	}
+	for i := len(indexers)-1; i >= 0; i-- {
+		err = indexers[i].DisconnectBlock(tx,b,height)
+		if err != nil {
+			return nil,err
+		}
+	}
+	return b,nil
+}
+
+//把顶端区块从链上断开，UTXO集恢复到该区块之前的状态，区块本身仍保留在数据库中。
+//区块没有撤销记录时返回ErrNoUndoData
+func (bc *Blockchain) DisconnectBlock() (*block.Block,error) {
+	var disconnected *block.Block
+	err := bc.update(func(tx *bolt.Tx,indexers []Indexer) error {
+		var err error
+		disconnected,err = bc.disconnect(tx,indexers)
+		return err
+	})
+	return disconnected,err
+}
+
+//把区块hash及其之后的区块从链上断开并把hash标记为无效，之后不会再被连接到链上。
+//返回被断开的区块，顶端区块在前
+func (bc *Blockchain) InvalidateBlock(hash []byte) ([]*block.Block,error) {
+	var disconnected []*block.Block
+	err := bc.update(func(tx *bolt.Tx,indexers []Indexer) error {
+		if tx.Bucket([]byte(blockHeightBucket)).Get(hash) == nil {
+			return fmt.Errorf("%w on the main chain: %x",ErrBlockNotFound,hash)
+		}
+		oldTip := append([]byte{},tx.Bucket([]byte(blocksBucket)).Get([]byte("l"))...)
+		for {
+			b,err := bc.disconnect(tx,indexers)
+			if err != nil {
+				return err
+			}
+			disconnected = append(disconnected,b)
+			if bytes.Equal(b.Hash,hash) {
+				break
+			}
+		}
+		return tx.Bucket([]byte(invalidBucket)).Put(hash,oldTip)
+	})
 	if err != nil {
-		log.Panic(err)
+		return nil,err
 	}
+	return disconnected,nil
+}
+
+//取消区块hash的无效标记，并把invalidateblock断开的区块重新连接到链上。
+//标记之后链上又加入了新的区块时返回ErrTipMoved。返回重新连接的区块，按连接顺序排列
+func (bc *Blockchain) ReconsiderBlock(hash []byte) ([]*block.Block,error) {
+	engine := bc.Engine()
+	var connected []*block.Block
+	err := bc.update(func(tx *bolt.Tx,indexers []Indexer) error {
+		invalid := tx.Bucket([]byte(invalidBucket))
+		oldTip := invalid.Get(hash)
+		if oldTip == nil {
+			return fmt.Errorf("%w: %x",ErrNotInvalidated,hash)
+		}
+		//从标记时的顶端往回找到hash，得到需要重新连接的区块
+		blocks := tx.Bucket([]byte(blocksBucket))
+		var path []*block.Block
+		current := append([]byte{},oldTip...)
+		for {
+			encodeBlock := blocks.Get(current)
+			if encodeBlock == nil {
+				return fmt.Errorf("%w: %x",ErrBlockNotFound,current)
+			}
+			b,err := block.DeserializeBlock(encodeBlock)
+			if err != nil {
+				return err
+			}
+			path = append(path,b)
+			if bytes.Equal(b.Hash,hash) {
+				break
+			}
+			current = b.PrevBlockHash
+		}
+		if !bytes.Equal(path[len(path)-1].PrevBlockHash,blocks.Get([]byte("l"))) {
+			return ErrTipMoved
+		}
+		err := invalid.Delete(hash)
+		if err != nil {
+			return err
+		}
 
-	err = b.Put(genesis.Hash, genesis.Serialize())//写入键值对，区块哈希对应序列化后的区块
+		for i := len(path)-1; i >= 0; i-- {
+			b := path[i]
+			//之后的区块被单独标记为无效时，只接回到它之前
+			if invalid.Get(b.Hash) != nil {
+				break
+			}
+			if !engine.VerifySeal(b) {
+				return fmt.Errorf("%w: %x",ErrInvalidSeal,b.Hash)
+			}
+			height,err := connectBlock(tx,b)
+			if err != nil {
+				return err
+			}
+			for _,idx := range indexers {
+				err = idx.ConnectBlock(tx,b,height)
+				if err != nil {
+					return err
+				}
+			}
+			connected = append(connected,b)
+		}
+		return nil
+	})
 	if err != nil {
-		log.Panic(err)
+		return nil,err
+	}
+	return connected,nil
+}
+
+//在一个读写事务中执行fn并在提交之后更新顶端，同一时间只有一个写者
+func (bc *Blockchain) update(fn func(tx *bolt.Tx,indexers []Indexer) error) error {
+	bc.writeMu.Lock()
+	defer bc.writeMu.Unlock()
+
+	bc.mu.RLock()
+	indexers := bc.indexers
+	bc.mu.RUnlock()
+
+	var tip []byte
+	err := bc.db.Update(func(tx *bolt.Tx) error {
+		err := fn(tx,indexers)
+		if err != nil {
+			return err
 		}
-	err = b.Put([]byte("l"), genesis.Hash)//"l"键对应区块链顶端区块的哈希
+		tip = append([]byte{},tx.Bucket([]byte(blocksBucket)).Get([]byte("l"))...)
+		return nil
+	})
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
-	tip = genesis.Hash //指向最后一个区块，这里也就是创世区块
+	bc.setTip(tip)
 	return nil
+}
+
+//高度编码为8字节大端序，使高度索引桶按高度排序
+func encodeHeight(height int) []byte {
+	buf := make([]byte,8)
+	binary.BigEndian.PutUint64(buf,uint64(height))
+	return buf
+}
+
+func decodeHeight(data []byte) int {
+	return int(binary.BigEndian.Uint64(data))
+}
+
+//写入区块哈希和高度的双向索引
+func putHeight(tx *bolt.Tx,hash []byte,height int) error {
+	err := tx.Bucket([]byte(heightBucket)).Put(encodeHeight(height),hash)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(blockHeightBucket)).Put(hash,encodeHeight(height))
+}
+
+//返回区块在链上的高度，创世区块为0，区块不在链上时返回ErrBlockNotFound
+func (bc *Blockchain) BlockHeight(hash []byte) (int,error) {
+	height := 0
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(blockHeightBucket)).Get(hash)
+		if data == nil {
+			return fmt.Errorf("%w: %x",ErrBlockNotFound,hash)
+		}
+		height = decodeHeight(data)
+		return nil
 	})
+	return height,err
+}
+
+//返回链顶端区块的高度
+func (bc *Blockchain) Height() (int,error) {
+	return bc.BlockHeight(bc.Tip())
+}
+
+//在数据库事务tx中读取链顶端区块的高度，例如交易池在写入交易的同一个事务中检查coinbase输出是否成熟
+func TipHeight(tx *bolt.Tx) (int,error) {
+	tip := tx.Bucket([]byte(blocksBucket)).Get([]byte("l"))
+	data := tx.Bucket([]byte(blockHeightBucket)).Get(tip)
+	if data == nil {
+		return 0,fmt.Errorf("%w: %x",ErrBlockNotFound,tip)
+	}
+	return decodeHeight(data),nil
+}
+
+//创建区块链数据库中用到的所有桶，已经存在的桶保持不变
+func createBuckets(tx *bolt.Tx) error {
+	for _,name := range []string{blocksBucket,UTXOBucket,UTXOAddrBucket,chainstateMetaBucket,heightBucket,blockHeightBucket,undoBucket,invalidBucket} {
+		_,err := tx.CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//启动时的一致性检查：UTXO集和高度索引都应该反映"l"指向的顶端区块。
+//进程在旧版本两次写入之间崩溃，或者数据库来自没有这些索引、使用旧存储格式的版本时会不一致，此时重建它们。
+//返回是否做了修复
+func (bc *Blockchain) CheckConsistency() (bool,error) {
+	consistent := false
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		tip := tx.Bucket([]byte(blocksBucket)).Get([]byte("l"))
+		meta := tx.Bucket([]byte(chainstateMetaBucket))
+		heights := tx.Bucket([]byte(blockHeightBucket))
+		for _,name := range []string{UTXOBucket,UTXOAddrBucket,chainstateMetaBucket,heightBucket,blockHeightBucket,undoBucket,invalidBucket} {
+			if tx.Bucket([]byte(name)) == nil {
+				return nil
+			}
+		}
+		version := meta.Get(versionKey)
+		consistent = len(version) == 1 && version[0] == chainstateVersion &&
+			bytes.Equal(meta.Get(bestBlockKey),tip) && heights.Get(tip) != nil
+		return nil
+	})
+	if err != nil || consistent {
+		return false,err
+	}
+	return true,bc.Reindex()
+}
+
+//根据链上的区块重建UTXO集和高度索引，撤销记录和无效标记保持不变
+func (bc *Blockchain) Reindex() error {
+	bc.writeMu.Lock()
+	defer bc.writeMu.Unlock()
+
+	//返回链上所有未花费交易中的交易输出
+	UTXO,err := bc.FindUTXO()
 	if err != nil {
-		log.Panic(err)
+		return err
+	}
+	//从顶端到创世区块的哈希
+	var hashes [][]byte
+	bci := bc.Iterator()
+	for {
+		b,err := bci.Next()
+		if err != nil {
+			return err
+		}
+		hashes = append(hashes,b.Hash)
+		if len(b.PrevBlockHash) == 0 {
+			break
+		}
 	}
 
-	bc := Blockchain{tip, db}
+	return bc.db.Update(func(tx *bolt.Tx) error {
+		//删除旧的桶后重新创建
+		for _,name := range []string{UTXOBucket,UTXOAddrBucket,chainstateMetaBucket,heightBucket,blockHeightBucket} {
+			err := tx.DeleteBucket([]byte(name))
+			if err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		err := createBuckets(tx)
+		if err != nil {
+			return err
+		}
 
-	return &bc
+		//把未花费交易中的交易输出集合写入桶中
+		utxos := tx.Bucket([]byte(UTXOBucket))
+		addrs := tx.Bucket([]byte(UTXOAddrBucket))
+		for txID,outs := range UTXO {
+			key,err := hex.DecodeString(txID)
+			if err != nil {
+				return err
+			}
+			for outIdx,entry := range outs {
+				err = addOutput(utxos,addrs,key,outIdx,entry)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		for i,hash := range hashes {
+			err = putHeight(tx,hash,len(hashes)-1-i)
+			if err != nil {
+				return err
+			}
+		}
+		meta := tx.Bucket([]byte(chainstateMetaBucket))
+		err = meta.Put(versionKey,[]byte{chainstateVersion})
+		if err != nil {
+			return err
+		}
+		return meta.Put(bestBlockKey,bc.Tip())
+	})
+}
+
+//创建创世区块  /修改/
+func NewGenesisBlock(coinbase *transaction.Transaction,engine consensus.Engine) (*block.Block,error) {
+	genesis := block.NewBlock([]*transaction.Transaction{coinbase},[]byte{})
+	err := engine.Seal(context.Background(),genesis)
+	if err != nil {
+		return nil,err
+	}
+	return genesis,nil
+}
+
+//创建区块链数据库
+//dbFile为数据库文件路径，engine为封装创世区块和之后区块使用的共识引擎，
+//区块链已经存在时返回ErrChainExists
+func CreateBlockchain(dbFile,address string,engine consensus.Engine) (*Blockchain,error) {
+	db,err := openDB(dbFile)
+	if err != nil {
+		return nil,err
+	}
+	//查看名字为blocksBucket的Bucket是否存在，存在的话就不用再挖创世区块了
+	err = db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(blocksBucket)) != nil {
+			return ErrChainExists
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil,err
+	}
+
+	//此时的创世区块就要包含交易coinbaseTx
+	cbtx,err := transaction.NewCoinbaseTX(address, chaincfg.ActiveNetParams.GenesisCoinbaseData)
+	if err != nil {
+		db.Close()
+		return nil,err
+	}
+	genesis,err := NewGenesisBlock(cbtx,engine)
+	if err != nil {
+		db.Close()
+		return nil,err
+	}
+
+	//读写操作数据库，创世区块和它的UTXO在同一个事务中写入
+	err = db.Update(func(tx *bolt.Tx) error{
+		if tx.Bucket([]byte(blocksBucket)) != nil {
+			return ErrChainExists
+		}
+		err := createBuckets(tx)
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket([]byte(blocksBucket)).Put(versionKey,[]byte{chainVersion})
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket([]byte(chainstateMetaBucket)).Put(versionKey,[]byte{chainstateVersion})
+		if err != nil {
+			return err
+		}
+		_,err = connectBlock(tx,genesis)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil,err
+	}
+
+	//指向最后一个区块，这里也就是创世区块
+	bc := Blockchain{tip: genesis.Hash, db: db, engine: engine, sigCache: wallet.NewSigCache(wallet.DefaultSigCacheSize)}
+
+	return &bc,nil
 }
 
 //实例化一个区块链,默认存储了创世区块 ,接收一个地址为挖矿奖励地址 /修改/
-func NewBlockchain() *Blockchain {
+//dbFile为数据库文件路径，区块链不存在时返回ErrChainNotFound，区块的存储格式不是chainVersion时返回ErrOldChainFormat，
+//数据库被另一个进程打开时返回ErrDatabaseLocked。
+//打开时会做一致性检查，UTXO集与链顶端不一致时自动重建
+func NewBlockchain(dbFile string) (*Blockchain,error) {
 	//return &Blockchain{[]*block.Block{NewGenesisBlock()}}
 	var tip []byte
 	//打开一个数据库文件，如果文件不存在则创建该名字的文件
-	db,err := bolt.Open(dbFile,0600,nil)
+	db,err := openDB(dbFile)
 	if err != nil {
-		log.Panic(err)
+		return nil,err
 	}
-	//读写操作数据库
-	err = db.Update(func(tx *bolt.Tx) error{
+	//只读操作数据库
+	err = db.View(func(tx *bolt.Tx) error{
 		b := tx.Bucket([]byte(blocksBucket))
 		//查看名字为blocksBucket的Bucket是否存在
 		if b == nil {
-			//不存在
-			fmt.Println("不存在区块链，需要重新创建一个区块链...")
-			os.Exit(1)
+			//不存在，需要重新创建一个区块链
+			return ErrChainNotFound
+		}
+		if version := b.Get(versionKey); len(version) != 1 || version[0] != chainVersion {
+			found := 1 //没有版本号的数据库来自版本1
+			if len(version) == 1 {
+				found = int(version[0])
+			}
+			return fmt.Errorf("%w: %s has format %d, want %d",ErrOldChainFormat,dbFile,found,chainVersion)
 		}
 		//如果存在blocksBucket桶，也就是存在区块链
 		//通过键"l"映射出顶端区块的Hash值
-		tip = b.Get([]byte("l"))
+		tip = append([]byte{},b.Get([]byte("l"))...) //Get返回的数据只在事务内有效
 
 		return nil
 	})
 	if err != nil {
-		log.Panic(err)
+		db.Close()
+		return nil,err
+	}
+
+	bc := Blockchain{tip: tip, db: db, engine: consensus.NewPoW(0), sigCache: wallet.NewSigCache(wallet.DefaultSigCacheSize)}  //此时Blockchain结构体字段已经变成这样了
+	_,err = bc.CheckConsistency()
+	if err != nil {
+		db.Close()
+		return nil,err
 	}
+	return &bc,nil
+}
 
-	bc := Blockchain{tip,db}  //此时Blockchain结构体字段已经变成这样了
-	return &bc
+//按哈希读取区块，区块不在数据库中时返回ErrBlockNotFound
+func (bc *Blockchain) GetBlock(hash []byte) (*block.Block,error) {
+	var b *block.Block
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		var err error
+		b,err = ReadBlock(tx,hash)
+		return err
+	})
+	if err != nil {
+		return nil,err
+	}
+	return b,nil
 }
 
 //分割线——————迭代器——————
@@ -163,15 +1256,17 @@ type BlockchainIterator struct {
 	currentHash 	[]byte
 	db 				*bolt.DB
 }
-//当需要遍历当前区块链时，创建一个此区块链的迭代器
+//当需要遍历当前区块链时，创建一个此区块链的迭代器。
+//迭代器从创建时的顶端开始遍历，区块按哈希存储且不会被修改，
+//所以之后有新的区块加入也不影响迭代器看到的是同一条链
 func (bc *Blockchain) Iterator() *BlockchainIterator {
-	bci := &BlockchainIterator{bc.tip,bc.db}
+	bci := &BlockchainIterator{bc.Tip(),bc.db}
 
 	return bci
 }
 
 //迭代器的任务就是返回链中的下一个区块
-func (i *BlockchainIterator) Next() *block.Block {
+func (i *BlockchainIterator) Next() (*block.Block,error) {
 	var Block *block.Block
 
 	//只读方式打开区块链数据库
@@ -179,19 +1274,23 @@ func (i *BlockchainIterator) Next() *block.Block {
 		b := tx.Bucket([]byte(blocksBucket))
 		//获取数据库中当前区块哈希对应的被序列化后的区块
 		encodeBlock := b.Get(i.currentHash)
+		if encodeBlock == nil {
+			return fmt.Errorf("%w: %x",ErrBlockNotFound,i.currentHash)
+		}
 		//反序列化，获得区块
-		Block = block.DeserializeBlock(encodeBlock)
+		var err error
+		Block,err = block.DeserializeBlock(encodeBlock)
 
-		return nil
+		return err
 	})
 	if err != nil {
-		log.Panic(err)
+		return nil,err
 	}
 
 	//把迭代器中的当前区块哈希设置为上一区块的哈希，实现迭代的作用
 	i.currentHash =Block.PrevBlockHash
 
-	return Block
+	return Block,nil
 
 }
 
@@ -258,9 +1357,12 @@ func (i *BlockchainIterator) Next() *block.Block {
 // }
  
 //通过找到未花费输出交易的集合，我们返回集合中的所有未花费交易的交易输出集合
-func (bc *Blockchain) FindUTXO() map[string]transaction.TXOutputs {
+func (bc *Blockchain) FindUTXO() (map[string]map[int]UTXOEntry,error) {
 	//var UTXOs []transaction.TXOutput
-	UTXO := make(map[string]transaction.TXOutputs)
+	//交易ID -> 输出序号 -> 输出，保留输出在交易中的原始序号
+	UTXO := make(map[string]map[int]UTXOEntry)
+	//从顶端往回数的区块深度，遍历完之后才知道区块高度
+	depth := 0
 	//找到address地址下的未花费交易输出的交易的集合
 	//unspentTransactions := bc.FindUnspentTransactions(pubKeyHash)
 	//创建一个map，存储已经花费了的交易输出
@@ -269,10 +1371,14 @@ func (bc *Blockchain) FindUTXO() map[string]transaction.TXOutputs {
 	bci := bc.Iterator()
 
 	for {
-		block := bci.Next()  //迭代
+		block,err := bci.Next()  //迭代
+		if err != nil {
+			return nil,err
+		}
 
-		//遍历当前区块上的交易
-		for _,tx := range block.Transactions {
+		//倒序遍历当前区块上的交易，同一区块中后面的交易可能花费前面交易的输出
+		for i := len(block.Transactions)-1; i >= 0; i-- {
+			tx := block.Transactions[i]
 			txID := hex.EncodeToString(tx.ID) //把交易ID转换成string类型，方便存入map中
 		
 		//标签
@@ -293,9 +1399,11 @@ func (bc *Blockchain) FindUTXO() map[string]transaction.TXOutputs {
 						}
 					}
 				}
-				outs := UTXO[txID]
-				outs.Outputs = append(outs.Outputs,out)
-				UTXO[txID] = outs
+				if UTXO[txID] == nil {
+					UTXO[txID] = make(map[int]UTXOEntry)
+				}
+				//暂时把深度存放在Height中
+				UTXO[txID][outIdx] = UTXOEntry{out,depth,tx.IsCoinbase()}
 			}
 			//判断是否为coinbase交易
 			if tx.IsCoinbase() == false { 		
@@ -310,6 +1418,14 @@ func (bc *Blockchain) FindUTXO() map[string]transaction.TXOutputs {
 		if len(block.PrevBlockHash) == 0 {
 			break
 		}
+		depth++
+	}
+	//此时depth为顶端区块的高度，把深度换算成高度
+	for _,outs := range UTXO {
+		for outIdx,entry := range outs {
+			entry.Height = depth-entry.Height
+			outs[outIdx] = entry
+		}
 	}
 	// //遍历交易集合得到交易，从交易中提取出输出字段Vout,从输出字段中提取出属于address的输出
 	// for _,tx := range unspentTransactions {
@@ -320,7 +1436,7 @@ func (bc *Blockchain) FindUTXO() map[string]transaction.TXOutputs {
 	// 	}
 	// }
 	//返回未花费交易输出
-	return UTXO
+	return UTXO,nil
 }
 
 
@@ -351,11 +1467,14 @@ func (bc *Blockchain) FindUTXO() map[string]transaction.TXOutputs {
 // 		return accumulated,unspentOutputs
 // }
 
-//通过交易ID找到一个交易
+//通过交易ID找到一个交易，找不到时返回ErrTxNotFound
 func (bc *Blockchain) FindTransaction(ID []byte) (transaction.Transaction,error) {
 	bci := bc.Iterator()
 	for {
-		block := bci.Next()
+		block,err := bci.Next()
+		if err != nil {
+			return transaction.Transaction{},err
+		}
 
 		for _,tx := range block.Transactions {
 			if bytes.Compare(tx.ID,ID) == 0 {
@@ -366,34 +1485,44 @@ func (bc *Blockchain) FindTransaction(ID []byte) (transaction.Transaction,error)
 			break
 		}
 	}
-	return transaction.Transaction{},errors.New("Transaction is not found")
+	return transaction.Transaction{},ErrTxNotFound
 }
 //对交易输入进行签名
-func (bc *Blockchain) SignTransaction(tx *transaction.Transaction,privKey ecdsa.PrivateKey) {
+func (bc *Blockchain) SignTransaction(tx *transaction.Transaction,privKey wallet.PrivateKey) error {
 	prevTXs := make(map[string]transaction.Transaction)
 	for _,vin :=range tx.Vin {
 		prevTX,err := bc.FindTransaction(vin.Txid) //找到输入引用的输出所在的交易
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
 		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
 	}
-	tx.Sign(privKey,prevTXs)
+	return tx.Sign(privKey,prevTXs)
 }
 
-//验证交易
-func (bc *Blockchain) VerifyTransaction(tx *transaction.Transaction) bool {
+//验证交易ID和签名，输入引用的输出从UTXO集中取出，不在UTXO集中时返回ErrTxNotFound
+func (bc *Blockchain) VerifyTransaction(tx *transaction.Transaction) (bool,error) {
 	if tx.IsCoinbase() {
-		return true
+		return bytes.Equal(tx.ID,tx.TxID()),nil
 	}
-	prevTXs := make(map[string]transaction.Transaction)
+	var prevOuts []transaction.TXOutput
+	err := bc.db.View(func(btx *bolt.Tx) error {
+		var err error
+		prevOuts,err = prevOutputs(btx.Bucket([]byte(UTXOBucket)),tx,nil)
+		return err
+	})
+	if err != nil {
+		return false,err
+	}
+	return bc.VerifyTransactionWithPrevOuts(tx,prevOuts),nil
+}
 
-	for _, vin := range tx.Vin {
-		prevTX,err := bc.FindTransaction(vin.Txid)
-		if err != nil {
-			log.Panic(err)
-		}
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+//用调用者给出的输入引用的输出(和Vin一一对应)验证交易ID和签名，
+//例如交易池中花费还没确认的交易的输出的交易。验证通过的签名加入签名缓存
+func (bc *Blockchain) VerifyTransactionWithPrevOuts(tx *transaction.Transaction,prevOuts []transaction.TXOutput) bool {
+	if !bytes.Equal(tx.ID,tx.TxID()) || len(prevOuts) != len(tx.Vin) {
+		return false
 	}
-	return tx.Verify(prevTXs) //验证签名
+	bv := wallet.NewBatchVerifier(bc.sigCache)
+	return tx.AddToBatch(bv,prevOuts) && bv.Verify()
 }
@@ -0,0 +1,241 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+
+	"go_code/A_golang_blockchain/block"
+	"go_code/A_golang_blockchain/chaincfg"
+	"go_code/A_golang_blockchain/consensus"
+	"go_code/A_golang_blockchain/transaction"
+	"go_code/A_golang_blockchain/wallet"
+)
+
+//在regtest上创建一条只有创世区块的链，返回数据库文件路径
+func createTestChain(t *testing.T) string {
+	t.Helper()
+	if err := chaincfg.SetActiveNet("regtest"); err != nil {
+		t.Fatal(err)
+	}
+	ws := &wallet.Wallets{Wallets: map[string]*wallet.Wallet{}}
+	addr, err := ws.CreateWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbFile := filepath.Join(t.TempDir(), "chain.db")
+	bc, err := CreateBlockchain(dbFile, addr, consensus.NewDev())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc.Db().Close()
+	return dbFile
+}
+
+//区块的存储格式不是当前版本的数据库拒绝打开
+func TestNewBlockchainRejectsOldFormat(t *testing.T) {
+	dbFile := createTestChain(t)
+	bc, err := NewBlockchain(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc.Db().Close()
+
+	for _, version := range [][]byte{nil, {chainVersion - 1}} {
+		db, err := bolt.Open(dbFile, 0600, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(blocksBucket))
+			if version == nil {
+				return b.Delete(versionKey)
+			}
+			return b.Put(versionKey, version)
+		})
+		db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		bc, err := NewBlockchain(dbFile)
+		if err == nil {
+			bc.Db().Close()
+		}
+		if !errors.Is(err, ErrOldChainFormat) {
+			t.Fatalf("version %v: NewBlockchain = %v, want %v", version, err, ErrOldChainFormat)
+		}
+	}
+}
+
+//数据库被打开时再次打开不会一直等待文件锁，而是返回ErrDatabaseLocked
+func TestNewBlockchainLocked(t *testing.T) {
+	dbFile := createTestChain(t)
+	bc, err := NewBlockchain(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Db().Close()
+
+	other, err := NewBlockchain(dbFile)
+	if err == nil {
+		other.Db().Close()
+	}
+	if !errors.Is(err, ErrDatabaseLocked) {
+		t.Fatalf("NewBlockchain = %v, want %v", err, ErrDatabaseLocked)
+	}
+}
+
+//SigHashAll签名的数据，和transaction包中sigHash的计算相同
+func sigHashAll(t *testing.T, tx *transaction.Transaction, inID int, prevOut transaction.TXOutput) []byte {
+	t.Helper()
+	txCopy, err := tx.TrimmedCopy(inID, transaction.SigHashAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txCopy.Vin[inID].PubKey = prevOut.PubkeyHash
+	hash := sha256.Sum256(append(txCopy.Hash(), byte(transaction.SigHashAll)))
+	return hash[:]
+}
+
+//同一个进程中，交易池验证交易时签名进入区块链的签名缓存，打包进区块时缓存中的签名不再验证
+func TestSigCacheSharedWithBlockValidation(t *testing.T) {
+	if err := chaincfg.SetActiveNet("regtest"); err != nil {
+		t.Fatal(err)
+	}
+	ws := &wallet.Wallets{Wallets: map[string]*wallet.Wallet{}}
+	addr, err := ws.CreateWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc, err := CreateBlockchain(filepath.Join(t.TempDir(), "chain.db"), addr, consensus.NewDev())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Db().Close()
+	mine := func(txs ...*transaction.Transaction) error {
+		cb, err := transaction.NewCoinbaseTX(addr, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = bc.MineBlock(context.Background(), append([]*transaction.Transaction{cb}, txs...))
+		return err
+	}
+	for i := 0; i < chaincfg.ActiveNetParams.CoinbaseMaturity; i++ {
+		if err := mine(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//花费创世区块的coinbase输出
+	utxos, err := bc.FindUTXO()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw transaction.RawTransaction
+	for txid, outs := range utxos {
+		for vout, entry := range outs {
+			if entry.Height == 0 {
+				id, _ := hex.DecodeString(txid)
+				raw = transaction.RawTransaction{
+					Tx: transaction.Transaction{
+						Vin:  []transaction.TXInput{{Txid: id, Vout: vout}},
+						Vout: []transaction.TXOutput{*transaction.NewTXOutput(entry.Output.Value, addr)},
+					},
+					PrevOuts: []transaction.TXOutput{entry.Output},
+				}
+			}
+		}
+	}
+	if _, err := raw.Sign(ws, transaction.SigHashAll); err != nil {
+		t.Fatal(err)
+	}
+	tx := &raw.Tx
+	vin := tx.Vin[0]
+	hash := sigHashAll(t, tx, 0, raw.PrevOuts[0])
+	sig := vin.Signature[:len(vin.Signature)-1]
+
+	//交易池用VerifyTransactionWithPrevOuts验证交易
+	if bc.sigCache.Contains(vin.PubKey, hash, sig) {
+		t.Fatal("signature is cached before it was verified")
+	}
+	if !bc.VerifyTransactionWithPrevOuts(tx, raw.PrevOuts) {
+		t.Fatal("transaction does not verify")
+	}
+	if !bc.sigCache.Contains(vin.PubKey, hash, sig) {
+		t.Fatal("mempool verification did not cache the signature")
+	}
+
+	//区块验证查找的是同样的缓存键：把一个无效签名放进缓存并换到交易中，区块仍然被接受，说明没有重新验证
+	forged := append([]byte{}, sig...)
+	forged[len(forged)-1] ^= 1
+	tx.Vin[0].Signature = append(forged, byte(transaction.SigHashAll))
+	if tx.VerifyPrevOuts(raw.PrevOuts) {
+		t.Fatal("forged signature verifies")
+	}
+	bc.sigCache.Add(vin.PubKey, hash, forged)
+	if err := mine(tx); err != nil {
+		t.Fatalf("block with a cached signature was verified again: %v", err)
+	}
+}
+
+//已经有创世区块的链拒绝第二个没有父区块的区块，区块中只有第一笔交易可以是coinbase
+func TestConnectBlockRejectsBadStructure(t *testing.T) {
+	if err := chaincfg.SetActiveNet("regtest"); err != nil {
+		t.Fatal(err)
+	}
+	ws := &wallet.Wallets{Wallets: map[string]*wallet.Wallet{}}
+	addr, err := ws.CreateWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc, err := CreateBlockchain(filepath.Join(t.TempDir(), "chain.db"), addr, consensus.NewDev())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Db().Close()
+	coinbase := func() *transaction.Transaction {
+		cb, err := transaction.NewCoinbaseTX(addr, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cb
+	}
+	tip := bc.Tip()
+
+	genesis := block.NewBlock([]*transaction.Transaction{coinbase()}, []byte{})
+	if err := bc.Engine().Seal(context.Background(), genesis); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.ConnectBlock(genesis); !errors.Is(err, ErrChainExists) {
+		t.Fatalf("second genesis block: ConnectBlock = %v, want %v", err, ErrChainExists)
+	}
+	if !bytes.Equal(bc.Tip(), tip) {
+		t.Fatal("second genesis block replaced the tip")
+	}
+
+	tests := []struct {
+		name string
+		txs  []*transaction.Transaction
+	}{
+		{"no transactions", nil},
+		{"two coinbases", []*transaction.Transaction{coinbase(), coinbase()}},
+	}
+	for _, tt := range tests {
+		if _, err := bc.MineBlock(context.Background(), tt.txs); !errors.Is(err, ErrBadCoinbasePosition) {
+			t.Errorf("%s: MineBlock = %v, want %v", tt.name, err, ErrBadCoinbasePosition)
+		}
+	}
+	height, err := bc.Height()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if height != 0 {
+		t.Fatalf("height = %d after rejected blocks, want 0", height)
+	}
+}
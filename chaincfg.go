@@ -0,0 +1,93 @@
+package chaincfg
+
+import (
+	"fmt"
+)
+
+/*
+	网络参数：把创世区块信息、挖矿难度、挖矿奖励、地址版本号、
+
+数据文件名等按网络打包在一起，不同的网络(mainnet/testnet/regtest)
+使用数据目录下不同的子目录，地址的版本号也不同，不能混用。
+*/
+type Params struct {
+	Name                string //网络名称
+	GenesisCoinbaseData string //创世区块coinbase交易附带的信息
+	TargetBits          int    //挖矿难度
+	Subsidy             int    //挖矿奖励
+	CoinbaseMaturity    int    //coinbase输出要经过多少个区块之后才能花费
+	AddressVersion      byte   //地址的版本号
+	PrivateKeyVersion   byte   //WIF格式私钥的版本号
+	Consensus           string //默认的共识引擎：pow、poa 或 dev
+	DBFile              string //区块链数据库文件名
+	WalletFile          string //钱包文件名
+	LedgerFile          string //钱包交易记录文件名
+}
+
+//主网
+var MainNetParams = Params{
+	Name:                "mainnet",
+	GenesisCoinbaseData: "The Times 03/Jan/2009 Chancellor on brink of second bailout for banks",
+	TargetBits:          10,
+	Subsidy:             50,
+	CoinbaseMaturity:    100,
+	AddressVersion:      0x00,
+	PrivateKeyVersion:   0x80,
+	Consensus:           "pow",
+	DBFile:              "blockchain.db",
+	WalletFile:          "wallet.dat",
+	LedgerFile:          "wallet_ledger.dat",
+}
+
+//测试网，难度更低
+var TestNetParams = Params{
+	Name:                "testnet",
+	GenesisCoinbaseData: "A_golang_blockchain testnet genesis block",
+	TargetBits:          8,
+	Subsidy:             50,
+	CoinbaseMaturity:    10,
+	AddressVersion:      0x6f,
+	PrivateKeyVersion:   0xef,
+	Consensus:           "pow",
+	DBFile:              "blockchain.db",
+	WalletFile:          "wallet.dat",
+	LedgerFile:          "wallet_ledger.dat",
+}
+
+//本地回归测试网络，区块立即封装
+var RegTestParams = Params{
+	Name:                "regtest",
+	GenesisCoinbaseData: "A_golang_blockchain regtest genesis block",
+	TargetBits:          1,
+	Subsidy:             50,
+	CoinbaseMaturity:    10,
+	AddressVersion:      0x3c,
+	PrivateKeyVersion:   0xef,
+	Consensus:           "dev",
+	DBFile:              "blockchain.db",
+	WalletFile:          "wallet.dat",
+	LedgerFile:          "wallet_ledger.dat",
+}
+
+//当前使用的网络参数，默认为主网
+var ActiveNetParams = &MainNetParams
+
+//通过名称找到网络参数
+func ParamsByName(name string) (*Params, error) {
+	for _, params := range []*Params{&MainNetParams, &TestNetParams, &RegTestParams} {
+		if params.Name == name {
+			return params, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown network %q", name)
+}
+
+//切换当前使用的网络
+func SetActiveNet(name string) error {
+	params, err := ParamsByName(name)
+	if err != nil {
+		return err
+	}
+	ActiveNetParams = params
+	return nil
+}
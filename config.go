@@ -0,0 +1,109 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+/*
+	节点配置：数据目录、网络、共识引擎、挖矿参数等全部节点设置。
+优先级从低到高为：默认值 < 配置文件(TOML) < 环境变量 < 命令行参数
+*/
+type Config struct {
+	DataDir      string   `toml:"datadir"`      //数据目录，每个网络在其中有自己的子目录
+	Network      string   `toml:"network"`      //mainnet、testnet 或 regtest
+	Consensus    string   `toml:"consensus"`    //共识引擎，为空时使用网络的默认值
+	Threads      int      `toml:"threads"`      //挖矿协程数，小于等于0时使用全部CPU核心
+	Authorities  []string `toml:"authorities"`  //权威证明中允许签署区块的地址
+	Signer       string   `toml:"signer"`       //权威证明中本节点签署区块使用的地址
+	MinerAddress string   `toml:"mineraddress"` //挖矿奖励地址
+	AddrIndex    bool     `toml:"addrindex"`    //是否维护地址历史索引，listtransactions需要
+}
+
+//配置文件名，默认放在数据目录下
+const ConfigFile = "config.toml"
+
+//环境变量前缀，例如 BLOCKCHAIN_DATADIR、BLOCKCHAIN_NETWORK
+const EnvPrefix = "BLOCKCHAIN_"
+
+//默认配置，数据目录为用户主目录下的 .a_golang_blockchain
+func Default() *Config {
+	return &Config{
+		DataDir: DefaultDataDir(),
+		Network: "mainnet",
+	}
+}
+
+//默认数据目录
+func DefaultDataDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".a_golang_blockchain"
+	}
+	return filepath.Join(home, ".a_golang_blockchain")
+}
+
+//从配置文件中读取配置，文件中没有设置的项保持默认值。
+//required为false时文件不存在不算错误
+func Load(path string, required bool) (*Config, error) {
+	cfg := Default()
+	if _, err := os.Stat(path); os.IsNotExist(err) && !required {
+		return cfg, nil
+	}
+	if _, err := toml.DecodeFile(path, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+//用环境变量覆盖配置
+func (c *Config) ApplyEnv() error {
+	if v, ok := lookupEnv("DATADIR"); ok {
+		c.DataDir = v
+	}
+	if v, ok := lookupEnv("NETWORK"); ok {
+		c.Network = v
+	}
+	if v, ok := lookupEnv("CONSENSUS"); ok {
+		c.Consensus = v
+	}
+	if v, ok := lookupEnv("THREADS"); ok {
+		threads, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		c.Threads = threads
+	}
+	if v, ok := lookupEnv("AUTHORITIES"); ok {
+		c.Authorities = strings.Split(v, ",")
+	}
+	if v, ok := lookupEnv("SIGNER"); ok {
+		c.Signer = v
+	}
+	if v, ok := lookupEnv("MINERADDRESS"); ok {
+		c.MinerAddress = v
+	}
+	if v, ok := lookupEnv("ADDRINDEX"); ok {
+		addrIndex, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		c.AddrIndex = addrIndex
+	}
+	return nil
+}
+
+//某个网络的数据目录
+func (c *Config) NetworkDir() string {
+	return filepath.Join(c.DataDir, c.Network)
+}
+
+//读取带前缀的环境变量，空值视为未设置
+func lookupEnv(name string) (string, bool) {
+	v, ok := os.LookupEnv(EnvPrefix + name)
+	return v, ok && v != ""
+}
@@ -0,0 +1,154 @@
+package consensus
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"go_code/A_golang_blockchain/block"
+	"go_code/A_golang_blockchain/pow"
+	"go_code/A_golang_blockchain/wallet"
+)
+
+/*
+	共识引擎：决定一个区块怎样才算被合法地封装(seal)。
+
+目前有三种实现：
+1、PoW  工作量证明，原来的SHA-256挖矿
+2、PoA  权威证明，区块由白名单中的钱包私钥签名，适合许可链
+3、Dev  开发模式，立即封装，不做任何工作，适合单元测试
+*/
+type Engine interface {
+	//封装区块，填充区块的哈希、nonce或签名，ctx被取消时放弃并返回ctx.Err()
+	Seal(ctx context.Context, b *block.Block) error
+	//验证区块的封装是否合法
+	VerifySeal(b *block.Block) bool
+}
+
+var (
+	ErrNoSigner           = errors.New("proof-of-authority engine has no signer")
+	ErrUnauthorizedSigner = errors.New("signer is not in the authority set")
+)
+
+//工作量证明引擎
+type PoW struct {
+	Threads int //挖矿协程数，小于等于0时使用全部CPU核心
+}
+
+func NewPoW(threads int) *PoW {
+	return &PoW{threads}
+}
+
+func (e *PoW) Seal(ctx context.Context, b *block.Block) error {
+	nonce, hash, err := pow.NewProofOfWork(b).RunParallel(ctx, e.Threads)
+	if err != nil {
+		return err
+	}
+	b.Nonce = nonce
+	b.Hash = hash
+	return nil
+}
+
+func (e *PoW) VerifySeal(b *block.Block) bool {
+	return pow.NewProofOfWork(b).Validate()
+}
+
+//权威证明引擎，Authorities为允许签署区块的地址的公钥哈希
+type PoA struct {
+	Authorities [][]byte
+	Signer      *wallet.Wallet //本节点用来签署区块的钱包，只验证区块时可以为空
+}
+
+//通过地址列表实例化权威证明引擎，地址无效或者不属于当前网络时返回wallet.ErrInvalidAddress
+func NewPoA(authorities []string, signer *wallet.Wallet) (*PoA, error) {
+	var hashes [][]byte
+	for _, address := range authorities {
+		if !wallet.ValidateAddress(address) {
+			return nil, fmt.Errorf("%w: authority %q", wallet.ErrInvalidAddress, address)
+		}
+		hashes = append(hashes, wallet.AddressPubKeyHash(address))
+	}
+	return &PoA{hashes, signer}, nil
+}
+
+func (e *PoA) Seal(ctx context.Context, b *block.Block) error {
+	if e.Signer == nil {
+		return ErrNoSigner
+	}
+	if !e.isAuthority(e.Signer.PublicKey) {
+		return ErrUnauthorizedSigner
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	hash := b.SealHash()
+	key, err := e.Signer.Key()
+	if err != nil {
+		return err
+	}
+	signature, err := key.Sign(hash)
+	if err != nil {
+		return err
+	}
+	b.Hash = hash
+	b.Nonce = 0
+	b.Signer = e.Signer.PublicKey
+	b.Signature = signature
+	return nil
+}
+
+func (e *PoA) VerifySeal(b *block.Block) bool {
+	if !bytes.Equal(b.Hash, b.SealHash()) || !e.isAuthority(b.Signer) {
+		return false
+	}
+	if len(b.Signature) != 64 || len(b.Signer) == 0 {
+		return false
+	}
+
+	//P-256的区块签名不要求s取较小的值，之前封装的区块仍然有效
+	if wallet.PubKeyType(b.Signer) != wallet.P256 {
+		return wallet.VerifySignature(b.Signer, b.Hash, b.Signature)
+	}
+	pubKey, err := wallet.ParsePubKey(b.Signer)
+	if err != nil {
+		return false
+	}
+	r := new(big.Int).SetBytes(b.Signature[:32])
+	s := new(big.Int).SetBytes(b.Signature[32:])
+	return ecdsa.Verify(pubKey, b.Hash, r, s)
+}
+
+//判断公钥是否属于白名单
+func (e *PoA) isAuthority(pubKey []byte) bool {
+	pubKeyHash := wallet.HashPubKey(pubKey)
+	for _, authority := range e.Authorities {
+		if bytes.Equal(authority, pubKeyHash) {
+			return true
+		}
+	}
+	return false
+}
+
+//开发模式引擎，区块立即被封装
+type Dev struct{}
+
+func NewDev() *Dev {
+	return &Dev{}
+}
+
+func (e *Dev) Seal(ctx context.Context, b *block.Block) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b.Hash = b.SealHash()
+	b.Nonce = 0
+	return nil
+}
+
+func (e *Dev) VerifySeal(b *block.Block) bool {
+	return bytes.Equal(b.Hash, b.SealHash())
+}
@@ -0,0 +1,38 @@
+package consensus
+
+import (
+	"errors"
+	"testing"
+
+	"go_code/A_golang_blockchain/chaincfg"
+	"go_code/A_golang_blockchain/wallet"
+)
+
+//白名单中的地址必须有效并且属于当前网络
+func TestNewPoAValidatesAuthorities(t *testing.T) {
+	if err := chaincfg.SetActiveNet("mainnet"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := wallet.NewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mainnetAddr := string(w.GetAddress())
+	if err := chaincfg.SetActiveNet("regtest"); err != nil {
+		t.Fatal(err)
+	}
+	regtestAddr := string(w.GetAddress())
+
+	e, err := NewPoA([]string{regtestAddr}, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.isAuthority(w.PublicKey) {
+		t.Fatal("signer is not an authority")
+	}
+	for _, bad := range []string{"foo", "", regtestAddr[:len(regtestAddr)-1], mainnetAddr} {
+		if _, err := NewPoA([]string{regtestAddr, bad}, w); !errors.Is(err, wallet.ErrInvalidAddress) {
+			t.Errorf("NewPoA(%q) = %v, want %v", bad, err, wallet.ErrInvalidAddress)
+		}
+	}
+}
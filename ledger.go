@@ -0,0 +1,257 @@
+package ledger
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"go_code/A_golang_blockchain/block"
+	"go_code/A_golang_blockchain/blockchain"
+	"go_code/A_golang_blockchain/transaction"
+	"go_code/A_golang_blockchain/wallet"
+)
+
+/*
+	钱包的交易记录：保存链上和钱包地址有关的交易(支付给钱包地址或者花费钱包地址的输出)，
+listunspent、gettransaction 直接从这里回答，不需要扫描整条链。
+交易记录和钱包文件分开保存，钱包只保存密钥
+*/
+
+//交易记录中没有该交易
+var ErrTxNotInWallet = errors.New("transaction is not in the wallet")
+
+//钱包交易记录中的一笔交易
+type WalletTx struct {
+	Tx			transaction.Transaction
+	Height		int	//交易所在区块的高度
+	BlockHash	[]byte
+}
+
+//钱包中一个未花费的输出
+type UnspentOutput struct {
+	Txid	[]byte
+	Vout	int
+	Output	transaction.TXOutput
+	Height	int
+}
+
+//钱包交易记录
+type Ledger struct {
+	Txs			map[string]*WalletTx //交易ID的十六进制 -> 交易
+	Height		int		//已经扫描到的区块高度
+	BestBlock	[]byte	//已经扫描到的区块哈希，为空表示还没有扫描过
+}
+
+//根据钱包中的地址(包括只读地址)生成判断公钥哈希是否属于钱包的函数
+func IsMineFunc(ws *wallet.Wallets) func(pubKeyHash []byte) bool {
+	mine := make(map[string]bool)
+	for _,pubKeyHash := range ws.PubKeyHashes() {
+		mine[string(pubKeyHash)] = true
+	}
+	return func(pubKeyHash []byte) bool {
+		return mine[string(pubKeyHash)]
+	}
+}
+
+//实例化钱包交易记录，并从ledgerFile中加载已有的记录，文件不存在时返回空的记录
+func NewLedger(ledgerFile string) (*Ledger,error) {
+	l := Ledger{Txs: make(map[string]*WalletTx)}
+	err := l.LoadFromFile(ledgerFile)
+	if os.IsNotExist(err) {
+		return &l,nil
+	}
+	if err != nil {
+		return nil,err
+	}
+	return &l,nil
+}
+
+//从文件中加载交易记录
+func (l *Ledger) LoadFromFile(ledgerFile string) error {
+	fileContent,err := ioutil.ReadFile(ledgerFile)
+	if err != nil {
+		return err
+	}
+	var loaded Ledger
+	err = gob.NewDecoder(bytes.NewReader(fileContent)).Decode(&loaded)
+	if err != nil {
+		return err
+	}
+	if loaded.Txs == nil {
+		loaded.Txs = make(map[string]*WalletTx)
+	}
+	*l = loaded
+	return nil
+}
+
+//将交易记录保存到文件
+func (l Ledger) SaveToFile(ledgerFile string) error {
+	var content bytes.Buffer
+	err := gob.NewEncoder(&content).Encode(l)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ledgerFile,content.Bytes(),0600)
+}
+
+//判断交易是否和钱包有关：有输出支付给钱包地址，或者有输入花费了钱包地址的输出
+func isRelevant(tx *transaction.Transaction,isMine func(pubKeyHash []byte) bool) bool {
+	for _,out := range tx.Vout {
+		if isMine(out.PubkeyHash) {
+			return true
+		}
+	}
+	if tx.IsCoinbase() {
+		return false
+	}
+	for _,vin := range tx.Vin {
+		if isMine(wallet.HashPubKey(vin.PubKey)) {
+			return true
+		}
+	}
+	return false
+}
+
+//把区块中和钱包有关的交易加入交易记录，返回加入的交易数
+func (l *Ledger) AddBlock(b *block.Block,height int,isMine func(pubKeyHash []byte) bool) int {
+	added := 0
+	for _,tx := range b.Transactions {
+		if !isRelevant(tx,isMine) {
+			continue
+		}
+		l.Txs[hex.EncodeToString(tx.ID)] = &WalletTx{*tx,height,b.Hash}
+		added++
+	}
+	l.Height = height
+	l.BestBlock = b.Hash
+	return added
+}
+
+//删除高度from及之后的记录，再通过迭代器从顶端往回取到高度from的区块，按顺序重新扫描
+func (l *Ledger) Rescan(bc *blockchain.Blockchain,from int,isMine func(pubKeyHash []byte) bool) error {
+	if from < 0 {
+		from = 0
+	}
+	for txID,wtx := range l.Txs {
+		if wtx.Height >= from {
+			delete(l.Txs,txID)
+		}
+	}
+
+	bci := bc.Iterator()
+	tip,err := bci.Next()
+	if err != nil {
+		return err
+	}
+	tipHeight,err := bc.BlockHeight(tip.Hash)
+	if err != nil {
+		return err
+	}
+	blocks := []*block.Block{tip}
+	for height := tipHeight-1; height >= from; height-- {
+		b,err := bci.Next()
+		if err != nil {
+			return err
+		}
+		blocks = append(blocks,b)
+	}
+	//blocks中的区块从顶端开始，高度依次减一
+	for i := len(blocks)-1; i >= 0; i-- {
+		if tipHeight-i < from {
+			continue
+		}
+		l.AddBlock(blocks[i],tipHeight-i,isMine)
+	}
+	l.Height = tipHeight
+	l.BestBlock = tip.Hash
+	return nil
+}
+
+//扫描上次扫描之后加入链的区块。上次扫描到的区块已经不在链上时(例如被invalidateblock断开)重新扫描整条链
+func (l *Ledger) Sync(bc *blockchain.Blockchain,isMine func(pubKeyHash []byte) bool) error {
+	if len(l.BestBlock) == 0 {
+		return l.Rescan(bc,0,isMine)
+	}
+	if bytes.Equal(l.BestBlock,bc.Tip()) {
+		return nil
+	}
+	height,err := bc.BlockHeight(l.BestBlock)
+	if errors.Is(err,blockchain.ErrBlockNotFound) {
+		return l.Rescan(bc,0,isMine)
+	}
+	if err != nil {
+		return err
+	}
+	return l.Rescan(bc,height+1,isMine)
+}
+
+//返回钱包中还没有被花费的输出，按高度排列。
+//花费钱包输出的交易一定带有钱包的公钥，所以也在交易记录中
+func (l *Ledger) Unspent(isMine func(pubKeyHash []byte) bool) []UnspentOutput {
+	spent := make(map[string]bool)
+	for _,wtx := range l.Txs {
+		if wtx.Tx.IsCoinbase() {
+			continue
+		}
+		for _,vin := range wtx.Tx.Vin {
+			spent[string(blockchain.OutpointKey(vin.Txid,vin.Vout))] = true
+		}
+	}
+
+	var unspent []UnspentOutput
+	for _,wtx := range l.Txs {
+		for outIdx,out := range wtx.Tx.Vout {
+			if !isMine(out.PubkeyHash) || spent[string(blockchain.OutpointKey(wtx.Tx.ID,outIdx))] {
+				continue
+			}
+			unspent = append(unspent,UnspentOutput{wtx.Tx.ID,outIdx,out,wtx.Height})
+		}
+	}
+	sort.Slice(unspent,func(i,j int) bool {
+		if unspent[i].Height != unspent[j].Height {
+			return unspent[i].Height < unspent[j].Height
+		}
+		if c := bytes.Compare(unspent[i].Txid,unspent[j].Txid); c != 0 {
+			return c < 0
+		}
+		return unspent[i].Vout < unspent[j].Vout
+	})
+	return unspent
+}
+
+//通过交易ID返回交易记录中的交易，不在记录中时返回ErrTxNotInWallet
+func (l *Ledger) GetTransaction(txid []byte) (*WalletTx,error) {
+	wtx,ok := l.Txs[hex.EncodeToString(txid)]
+	if !ok {
+		return nil,fmt.Errorf("%w: %x",ErrTxNotInWallet,txid)
+	}
+	return wtx,nil
+}
+
+//计算交易对钱包的影响：received为支付给钱包地址的金额，sent为花费掉的钱包输出的金额。
+//被花费的输出由交易记录中的交易得到
+func (l *Ledger) Amounts(wtx *WalletTx,isMine func(pubKeyHash []byte) bool) (int,int) {
+	received,sent := 0,0
+	for _,out := range wtx.Tx.Vout {
+		if isMine(out.PubkeyHash) {
+			received += out.Value
+		}
+	}
+	if wtx.Tx.IsCoinbase() {
+		return received,sent
+	}
+	for _,vin := range wtx.Tx.Vin {
+		prev,ok := l.Txs[hex.EncodeToString(vin.Txid)]
+		if !ok || vin.Vout < 0 || vin.Vout >= len(prev.Tx.Vout) {
+			continue
+		}
+		if out := prev.Tx.Vout[vin.Vout]; isMine(out.PubkeyHash) {
+			sent += out.Value
+		}
+	}
+	return received,sent
+}
@@ -0,0 +1,470 @@
+package mempool
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+	"go_code/A_golang_blockchain/blockchain"
+	"go_code/A_golang_blockchain/transaction"
+	"go_code/A_golang_blockchain/utxo"
+)
+
+/*
+	交易池：存放已经验证但还没有被打包进区块的交易，
+
+交易池和区块链保存在同一个数据库文件中，矿工从这里取出交易生成区块模板。
+*/
+const mempoolBucket = "mempool"
+
+var (
+	ErrCoinbaseTx    = errors.New("coinbase transaction is not allowed in mempool")
+	ErrTxExists      = errors.New("transaction already in mempool")
+	ErrInvalidTx     = errors.New("transaction signature is invalid")
+	ErrMissingInputs = errors.New("transaction spends outputs that are not in the UTXO set or mempool")
+	ErrDoubleSpend   = errors.New("transaction conflicts with a transaction in mempool")
+	//替换交易的手续费不高于被替换的交易的手续费之和
+	ErrInsufficientFee = errors.New("replacement fee is not higher than the fees of the replaced transactions")
+	//交易不在交易池中，例如已经被打包进区块
+	ErrTxNotInPool = errors.New("transaction is not in mempool")
+)
+
+//交易池结构体
+type Mempool struct {
+	Blockchain *blockchain.Blockchain
+	//交易放入交易池之后调用，可以为nil，例如通知矿工重新生成区块模板
+	OnAdd func(tx *transaction.Transaction)
+}
+
+//交易池中的一笔交易，以及挑选交易打包进区块需要的信息
+type TxDesc struct {
+	Tx      *transaction.Transaction
+	Fee     int       //手续费
+	Size    int       //序列化后的字节数
+	Parents []*TxDesc //交易池中被它花费了输出的交易，必须排在它前面打包
+}
+
+/*
+	验证交易并加入交易池。输入可以引用交易池中还没确认的交易的输出。
+和交易池中的交易花费了同一个输出时，被冲突的交易都声明了可以替换(Replaceable)，
+并且新交易的手续费高于被冲突的交易及其后代的手续费之和，才会替换掉它们，
+否则返回ErrDoubleSpend或ErrInsufficientFee。
+检查和写入在同一个读写事务中完成，同时加入的两笔冲突交易不会都通过检查
+*/
+func (m Mempool) Add(tx *transaction.Transaction) error {
+	if tx.IsCoinbase() {
+		return ErrCoinbaseTx
+	}
+	err := m.Blockchain.Db().Update(func(btx *bolt.Tx) error {
+		tipHeight, err := blockchain.TipHeight(btx)
+		if err != nil {
+			return err
+		}
+		v, err := viewTx(btx)
+		if err != nil {
+			return err
+		}
+		if _, ok := v.txs[string(tx.ID)]; ok {
+			return ErrTxExists
+		}
+		//交易最早会被打包进下一个区块
+		prevOuts, err := v.prevOutputs(tx, tipHeight+1)
+		if err != nil {
+			return err
+		}
+		fee := tx.Fee(prevOuts)
+		if fee < 0 {
+			return fmt.Errorf("%w: %x", blockchain.ErrNegativeFee, tx.ID)
+		}
+		if !m.Blockchain.VerifyTransactionWithPrevOuts(tx, prevOuts) {
+			return ErrInvalidTx
+		}
+		replaced, err := v.replacements(tx, fee)
+		if err != nil {
+			return err
+		}
+
+		b, err := btx.CreateBucketIfNotExists([]byte(mempoolBucket))
+		if err != nil {
+			return err
+		}
+		for _, r := range replaced {
+			if err := b.Delete(r.ID); err != nil {
+				return err
+			}
+		}
+		return b.Put(tx.ID, tx.Serialize())
+	})
+	if err != nil {
+		return err
+	}
+	if m.OnAdd != nil {
+		m.OnAdd(tx)
+	}
+	return nil
+}
+
+//取出交易池中的一笔交易和它的各输入引用的输出，不在交易池中时返回ErrTxNotInPool
+func (m Mempool) Get(id []byte) (*transaction.Transaction, []transaction.TXOutput, error) {
+	v, err := m.view()
+	if err != nil {
+		return nil, nil, err
+	}
+	tx, ok := v.txs[string(id)]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %x", ErrTxNotInPool, id)
+	}
+	prevOuts, err := v.prevOutputs(tx, -1)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tx, prevOuts, nil
+}
+
+/*
+	返回交易池中可以打包进高度为height的区块的交易，父交易排在子交易前面。
+引用的输出已经不存在(例如被区块中的其他交易花费)的交易和它们的后代放在stale中，可以从交易池中删除；
+花费的coinbase输出还没有成熟的交易和它们的后代不在结果中，留在交易池中等待之后的区块
+*/
+func (m Mempool) Descs(height int) ([]*TxDesc, []*transaction.Transaction, error) {
+	v, err := m.view()
+	if err != nil {
+		return nil, nil, err
+	}
+	var descs []*TxDesc
+	var stale []*transaction.Transaction
+	//nil表示交易不能打包：已经失效或者还没有成熟
+	visited := make(map[string]*TxDesc)
+	invalid := make(map[string]bool)
+	var visit func(tx *transaction.Transaction) (*TxDesc, error)
+	visit = func(tx *transaction.Transaction) (*TxDesc, error) {
+		if desc, ok := visited[string(tx.ID)]; ok {
+			return desc, nil
+		}
+		visited[string(tx.ID)] = nil
+		desc := &TxDesc{Tx: tx, Size: len(tx.Serialize())}
+		for _, vin := range tx.Vin {
+			parent, ok := v.txs[string(vin.Txid)]
+			if !ok {
+				continue
+			}
+			pdesc, err := visit(parent)
+			if err != nil {
+				return nil, err
+			}
+			if pdesc == nil {
+				if invalid[string(parent.ID)] {
+					invalid[string(tx.ID)] = true
+				}
+				return nil, nil
+			}
+			desc.Parents = append(desc.Parents, pdesc)
+		}
+		prevOuts, err := v.prevOutputs(tx, height)
+		if errors.Is(err, blockchain.ErrImmatureSpend) {
+			return nil, nil
+		}
+		if errors.Is(err, ErrMissingInputs) {
+			invalid[string(tx.ID)] = true
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		desc.Fee = tx.Fee(prevOuts)
+		visited[string(tx.ID)] = desc
+		descs = append(descs, desc)
+		return desc, nil
+	}
+	for _, tx := range v.order {
+		if _, err := visit(tx); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, tx := range v.order {
+		if invalid[string(tx.ID)] {
+			stale = append(stale, tx)
+		}
+	}
+	return descs, stale, nil
+}
+
+//返回交易池中的全部交易
+func (m Mempool) Transactions() ([]*transaction.Transaction, error) {
+	var txs []*transaction.Transaction
+
+	err := m.Blockchain.Db().View(func(btx *bolt.Tx) error {
+		var err error
+		txs, err = readTransactions(btx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return txs, nil
+}
+
+//在数据库事务btx中读出交易池中的全部交易
+func readTransactions(btx *bolt.Tx) ([]*transaction.Transaction, error) {
+	var txs []*transaction.Transaction
+	b := btx.Bucket([]byte(mempoolBucket))
+	if b == nil {
+		return nil, nil
+	}
+	err := b.ForEach(func(k, v []byte) error {
+		tx, err := transaction.DeserializeTransaction(v)
+		if err != nil {
+			return err
+		}
+		txs = append(txs, &tx)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return txs, nil
+}
+
+//把已经被打包进区块的交易从交易池中删除
+func (m Mempool) Remove(txs []*transaction.Transaction) error {
+	return m.Blockchain.Db().Update(func(btx *bolt.Tx) error {
+		b := btx.Bucket([]byte(mempoolBucket))
+		if b == nil {
+			return nil
+		}
+		for _, tx := range txs {
+			if err := b.Delete(tx.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+//交易池中的交易对地址余额的影响：支付给该地址的金额减去花费掉的该地址的输出
+func (m Mempool) UnconfirmedBalance(pubKeyHash []byte) (int, error) {
+	v, err := m.view()
+	if err != nil {
+		return 0, err
+	}
+	balance := 0
+	for _, tx := range v.order {
+		for _, out := range tx.Vout {
+			if out.IsLockedWithKey(pubKeyHash) {
+				balance += out.Value
+			}
+		}
+		for _, vin := range tx.Vin {
+			out, err := v.prevOutput(vin)
+			if err != nil {
+				return 0, err
+			}
+			if out != nil && out.IsLockedWithKey(pubKeyHash) {
+				balance -= out.Value
+			}
+		}
+	}
+	return balance, nil
+}
+
+//可以花费的一个输出
+type Coin struct {
+	Txid   []byte
+	Vout   int
+	Output transaction.TXOutput
+}
+
+/*
+	为pubKeyHash选择总额不少于amount的输出，返回选中的输出和它们的总额，总额不够时返回找到的全部输出。
+
+只使用确认数不少于minConf并且已经成熟的输出，跳过已经被交易池中的交易花费的输出，
+避免连续发送时新交易和交易池中还没确认的交易花费同一个输出。
+minConf小于等于0时，确认的输出不够还会使用交易池中的交易支付给pubKeyHash的输出(例如自己的找零)，
+这样可以花费还没确认的交易的输出，提高手续费让矿工把父交易一起打包(CPFP)。
+*/
+func (m Mempool) SelectCoins(pubKeyHash []byte, amount, minConf int) ([]Coin, int, error) {
+	v, err := m.view()
+	if err != nil {
+		return nil, 0, err
+	}
+	var coins []Coin
+	accumulated := 0
+	err = utxo.UTXOSet{Blockchain: m.Blockchain}.ForEachSpendable(pubKeyHash, minConf, func(txid []byte, vout int, entry blockchain.UTXOEntry) bool {
+		if _, spent := v.spentBy[string(blockchain.OutpointKey(txid, vout))]; spent {
+			return true
+		}
+		coins = append(coins, Coin{Txid: txid, Vout: vout, Output: entry.Output})
+		accumulated += entry.Output.Value
+		return accumulated < amount
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if minConf > 0 {
+		return coins, accumulated, nil
+	}
+	for _, tx := range v.order {
+		for vout, out := range tx.Vout {
+			if accumulated >= amount {
+				return coins, accumulated, nil
+			}
+			if !out.IsLockedWithKey(pubKeyHash) {
+				continue
+			}
+			if _, spent := v.spentBy[string(blockchain.OutpointKey(tx.ID, vout))]; spent {
+				continue
+			}
+			coins = append(coins, Coin{Txid: tx.ID, Vout: vout, Output: out})
+			accumulated += out.Value
+		}
+	}
+	return coins, accumulated, nil
+}
+
+//返回交易池中的交易数
+func (m Mempool) Count() (int, error) {
+	txs, err := m.Transactions()
+	return len(txs), err
+}
+
+//某一时刻的交易池，按交易ID和被花费的输出建立索引
+type poolView struct {
+	//返回输出在UTXO集中的条目，输出不在UTXO集中时返回nil
+	utxoEntry func(txid []byte, vout int) (*blockchain.UTXOEntry, error)
+	order   []*transaction.Transaction          //数据库中的顺序
+	txs     map[string]*transaction.Transaction //键为交易ID
+	spentBy map[string]*transaction.Transaction //键为被花费的输出的OutpointKey
+}
+
+//读出交易池中的全部交易并建立索引
+func (m Mempool) view() (*poolView, error) {
+	txs, err := m.Transactions()
+	if err != nil {
+		return nil, err
+	}
+	return newView(txs, utxo.UTXOSet{Blockchain: m.Blockchain}.GetEntry), nil
+}
+
+//在读写事务btx中读出交易池并建立索引，UTXO集也从btx中读取，视图只能在这个事务中使用
+func viewTx(btx *bolt.Tx) (*poolView, error) {
+	txs, err := readTransactions(btx)
+	if err != nil {
+		return nil, err
+	}
+	utxos := btx.Bucket([]byte(blockchain.UTXOBucket))
+	return newView(txs, func(txid []byte, vout int) (*blockchain.UTXOEntry, error) {
+		data := utxos.Get(blockchain.OutpointKey(txid, vout))
+		if data == nil {
+			return nil, nil
+		}
+		entry, err := blockchain.DeserializeUTXOEntry(data)
+		return &entry, err
+	}), nil
+}
+
+//按交易ID和被花费的输出为txs建立索引，utxoEntry用来查找UTXO集中的输出
+func newView(txs []*transaction.Transaction, utxoEntry func(txid []byte, vout int) (*blockchain.UTXOEntry, error)) *poolView {
+	v := &poolView{
+		utxoEntry: utxoEntry,
+		order:     txs,
+		txs:       make(map[string]*transaction.Transaction),
+		spentBy:   make(map[string]*transaction.Transaction),
+	}
+	for _, tx := range txs {
+		v.txs[string(tx.ID)] = tx
+		for _, vin := range tx.Vin {
+			v.spentBy[string(blockchain.OutpointKey(vin.Txid, vin.Vout))] = tx
+		}
+	}
+	return v
+}
+
+//输入引用的输出：引用交易池中的交易时取它的输出，否则从UTXO集中取出，都找不到时返回nil
+func (v *poolView) prevOutput(vin transaction.TXInput) (*transaction.TXOutput, error) {
+	if parent, ok := v.txs[string(vin.Txid)]; ok {
+		if vin.Vout < 0 || vin.Vout >= len(parent.Vout) {
+			return nil, nil
+		}
+		return &parent.Vout[vin.Vout], nil
+	}
+	entry, err := v.utxoEntry(vin.Txid, vin.Vout)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	return &entry.Output, nil
+}
+
+//找出交易各输入引用的输出，和Vin一一对应，找不到时返回ErrMissingInputs。
+//height大于等于0时还检查花费的coinbase输出在该高度是否已经成熟，没有成熟时返回blockchain.ErrImmatureSpend
+func (v *poolView) prevOutputs(tx *transaction.Transaction, height int) ([]transaction.TXOutput, error) {
+	prevOuts := make([]transaction.TXOutput, len(tx.Vin))
+	for i, vin := range tx.Vin {
+		out, err := v.prevOutput(vin)
+		if err != nil {
+			return nil, err
+		}
+		if out == nil {
+			return nil, fmt.Errorf("%w: %x:%d", ErrMissingInputs, vin.Txid, vin.Vout)
+		}
+		prevOuts[i] = *out
+		if _, ok := v.txs[string(vin.Txid)]; ok || height < 0 {
+			continue
+		}
+		entry, err := v.utxoEntry(vin.Txid, vin.Vout)
+		if err != nil {
+			return nil, err
+		}
+		if !entry.IsMature(height) {
+			return nil, fmt.Errorf("%w %x:%d", blockchain.ErrImmatureSpend, vin.Txid, vin.Vout)
+		}
+	}
+	return prevOuts, nil
+}
+
+//新交易要替换掉的交易：和它花费了同一个输出的交易，以及这些交易在交易池中的后代。
+//被冲突的交易必须都声明了可以替换，新交易不能花费被替换的交易的输出，并且手续费fee必须高于被替换的交易的手续费之和
+func (v *poolView) replacements(tx *transaction.Transaction, fee int) ([]*transaction.Transaction, error) {
+	var conflicts []*transaction.Transaction
+	seen := make(map[string]bool)
+	for _, vin := range tx.Vin {
+		ptx, ok := v.spentBy[string(blockchain.OutpointKey(vin.Txid, vin.Vout))]
+		if !ok || seen[string(ptx.ID)] {
+			continue
+		}
+		if !ptx.Replaceable {
+			return nil, fmt.Errorf("%w: %x is not replaceable", ErrDoubleSpend, ptx.ID)
+		}
+		seen[string(ptx.ID)] = true
+		conflicts = append(conflicts, ptx)
+	}
+
+	//加上被冲突的交易的后代，它们引用的输出替换之后就不存在了
+	replaced := conflicts
+	for i := 0; i < len(replaced); i++ {
+		for outIdx := range replaced[i].Vout {
+			child, ok := v.spentBy[string(blockchain.OutpointKey(replaced[i].ID, outIdx))]
+			if ok && !seen[string(child.ID)] {
+				seen[string(child.ID)] = true
+				replaced = append(replaced, child)
+			}
+		}
+	}
+	for _, vin := range tx.Vin {
+		if seen[string(vin.Txid)] {
+			return nil, fmt.Errorf("%w: spends an output of replaced transaction %x", ErrDoubleSpend, vin.Txid)
+		}
+	}
+
+	replacedFee := 0
+	for _, r := range replaced {
+		prevOuts, err := v.prevOutputs(r, -1)
+		if err != nil {
+			return nil, err
+		}
+		replacedFee += r.Fee(prevOuts)
+	}
+	if len(replaced) > 0 && fee <= replacedFee {
+		return nil, fmt.Errorf("%w: %d <= %d", ErrInsufficientFee, fee, replacedFee)
+	}
+	return replaced, nil
+}
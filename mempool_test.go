@@ -0,0 +1,265 @@
+package mempool
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"go_code/A_golang_blockchain/blockchain"
+	"go_code/A_golang_blockchain/chaincfg"
+	"go_code/A_golang_blockchain/consensus"
+	"go_code/A_golang_blockchain/transaction"
+	"go_code/A_golang_blockchain/wallet"
+)
+
+//在regtest上创建一条链，挖到创世区块的coinbase输出成熟为止
+func newTestChain(t *testing.T) (*blockchain.Blockchain, *wallet.Wallets, string) {
+	t.Helper()
+	if err := chaincfg.SetActiveNet("regtest"); err != nil {
+		t.Fatal(err)
+	}
+	ws := &wallet.Wallets{Wallets: map[string]*wallet.Wallet{}}
+	addr, err := ws.CreateWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc, err := blockchain.CreateBlockchain(filepath.Join(t.TempDir(), "chain.db"), addr, consensus.NewDev())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bc.Db().Close() })
+	for i := 0; i < chaincfg.ActiveNetParams.CoinbaseMaturity; i++ {
+		mineCoinbase(t, bc, addr)
+	}
+	return bc, ws, addr
+}
+
+//挖一个只有coinbase交易的区块
+func mineCoinbase(t *testing.T, bc *blockchain.Blockchain, to string) {
+	t.Helper()
+	cb, err := transaction.NewCoinbaseTX(to, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bc.MineBlock(context.Background(), []*transaction.Transaction{cb}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//返回高度为height的区块的coinbase输出
+func coinbaseOutput(t *testing.T, bc *blockchain.Blockchain, height int) (transaction.TXInput, transaction.TXOutput) {
+	t.Helper()
+	utxos, err := bc.FindUTXO()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for txid, outs := range utxos {
+		for vout, entry := range outs {
+			if entry.Height == height {
+				id, _ := hex.DecodeString(txid)
+				return transaction.TXInput{Txid: id, Vout: vout}, entry.Output
+			}
+		}
+	}
+	t.Fatalf("coinbase output at height %d not found", height)
+	return transaction.TXInput{}, transaction.TXOutput{}
+}
+
+//攻击者用自己的密钥签名花费别人地址上的输出，交易池和区块都拒绝这笔交易
+func TestRejectSpendWithForeignKey(t *testing.T) {
+	bc, _, _ := newTestChain(t)
+	attacker, err := wallet.NewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, prevOut := coinbaseOutput(t, bc, 0)
+	in.PubKey = attacker.PublicKey
+	tx := &transaction.Transaction{
+		Vin:  []transaction.TXInput{in},
+		Vout: []transaction.TXOutput{*transaction.NewTXOutput(prevOut.Value, string(attacker.GetAddress()))},
+	}
+	tx.ID = tx.TxID()
+	key, err := attacker.Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.SignInput(0, key, prevOut, transaction.SigHashAll); err != nil {
+		t.Fatal(err)
+	}
+
+	pool := Mempool{Blockchain: bc}
+	if err := pool.Add(tx); !errors.Is(err, ErrInvalidTx) {
+		t.Fatalf("mempool Add = %v, want %v", err, ErrInvalidTx)
+	}
+	cb, err := transaction.NewCoinbaseTX(string(attacker.GetAddress()), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = bc.MineBlock(context.Background(), []*transaction.Transaction{cb, tx})
+	if !errors.Is(err, blockchain.ErrInvalidTx) {
+		t.Fatalf("MineBlock = %v, want %v", err, blockchain.ErrInvalidTx)
+	}
+}
+
+//同时加入花费同一个输出的多笔交易，只有一笔能进入交易池
+func TestConcurrentDoubleSpend(t *testing.T) {
+	bc, ws, addr := newTestChain(t)
+	in, prevOut := coinbaseOutput(t, bc, 0)
+	const n = 32
+	txs := make([]*transaction.Transaction, n)
+	for i := range txs {
+		raw := transaction.RawTransaction{
+			Tx: transaction.Transaction{
+				Vin:  []transaction.TXInput{in},
+				Vout: []transaction.TXOutput{*transaction.NewTXOutput(prevOut.Value-i, addr)},
+			},
+			PrevOuts: []transaction.TXOutput{prevOut},
+		}
+		if _, err := raw.Sign(ws, transaction.SigHashAll); err != nil {
+			t.Fatal(err)
+		}
+		txs[i] = &raw.Tx
+	}
+
+	pool := Mempool{Blockchain: bc}
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i, tx := range txs {
+		wg.Add(1)
+		go func(i int, tx *transaction.Transaction) {
+			defer wg.Done()
+			errs[i] = pool.Add(tx)
+		}(i, tx)
+	}
+	wg.Wait()
+
+	added := 0
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			added++
+		case !errors.Is(err, ErrDoubleSpend):
+			t.Errorf("Add tx %d = %v, want nil or %v", i, err, ErrDoubleSpend)
+		}
+	}
+	if added != 1 {
+		t.Fatalf("%d conflicting transactions were accepted, want 1", added)
+	}
+	if count, err := pool.Count(); err != nil || count != 1 {
+		t.Fatalf("mempool has %d transactions (err %v), want 1", count, err)
+	}
+}
+
+//挖矿和加入交易的同时，多个读者遍历区块链、读取高度和交易池，用go test -race运行
+func TestConcurrentReaders(t *testing.T) {
+	bc, ws, addr := newTestChain(t)
+	const rounds = 8
+	//每一轮花费一个已经成熟的coinbase输出
+	txs := make([]*transaction.Transaction, rounds)
+	for i := range txs {
+		in, prevOut := coinbaseOutput(t, bc, i)
+		raw := transaction.RawTransaction{
+			Tx: transaction.Transaction{
+				Vin:  []transaction.TXInput{in},
+				Vout: []transaction.TXOutput{*transaction.NewTXOutput(prevOut.Value, addr)},
+			},
+			PrevOuts: []transaction.TXOutput{prevOut},
+		}
+		if _, err := raw.Sign(ws, transaction.SigHashAll); err != nil {
+			t.Fatal(err)
+		}
+		txs[i] = &raw.Tx
+	}
+	pool := Mempool{Blockchain: bc}
+
+	var stop int32
+	var wg sync.WaitGroup
+	const readers = 4
+	readerErrs := make([]error, readers)
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			readerErrs[r] = readChain(bc, pool, &stop)
+		}(r)
+	}
+
+	var writerErr error
+	for _, tx := range txs {
+		if writerErr = pool.Add(tx); writerErr != nil {
+			break
+		}
+		cb, err := transaction.NewCoinbaseTX(addr, "")
+		if err != nil {
+			writerErr = err
+			break
+		}
+		if _, writerErr = bc.MineBlock(context.Background(), []*transaction.Transaction{cb, tx}); writerErr != nil {
+			break
+		}
+		if writerErr = pool.Remove([]*transaction.Transaction{tx}); writerErr != nil {
+			break
+		}
+	}
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+
+	if writerErr != nil {
+		t.Fatal(writerErr)
+	}
+	for r, err := range readerErrs {
+		if err != nil {
+			t.Errorf("reader %d: %v", r, err)
+		}
+	}
+	height, err := bc.Height()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := chaincfg.ActiveNetParams.CoinbaseMaturity + rounds; height != want {
+		t.Fatalf("height = %d, want %d", height, want)
+	}
+}
+
+//一直读到stop被置为1：高度不会减小，迭代器从创建时的顶端遍历到创世区块
+func readChain(bc *blockchain.Blockchain, pool Mempool, stop *int32) error {
+	last := 0
+	for atomic.LoadInt32(stop) == 0 {
+		before, err := bc.Height()
+		if err != nil {
+			return err
+		}
+		if before < last {
+			return fmt.Errorf("height went back from %d to %d", last, before)
+		}
+		bci := bc.Iterator()
+		blocks := 0
+		for {
+			b, err := bci.Next()
+			if err != nil {
+				return err
+			}
+			blocks++
+			if len(b.PrevBlockHash) == 0 {
+				break
+			}
+		}
+		after, err := bc.Height()
+		if err != nil {
+			return err
+		}
+		if blocks < before+1 || blocks > after+1 {
+			return fmt.Errorf("iterated %d blocks, height was %d then %d", blocks, before, after)
+		}
+		if _, err := pool.Count(); err != nil {
+			return err
+		}
+		last = after
+	}
+	return nil
+}
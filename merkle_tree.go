@@ -40,19 +40,18 @@ func NewMerkleNode(left,right *MerkleNode,data []byte) *MerkleNode {
 func NewMerkleTree(data [][]byte) *MerkleTree {
 	var nodes []MerkleNode
 
-	//输入的交易个数如果是单数的话，就复制最后一个，成为复数
-	if len(data) % 2 != 0 {
-		data = append(data,data[len(data) - 1])
-	}
-
 	//通过数据生成叶子节点
 	for _,datum := range data {
 		node := NewMerkleNode(nil,nil,datum)
 		nodes = append(nodes,*node)
 	}
 	
-	//循环一层一层的生成节点，知道到最上面的根节点为止
-	for i := 0; i < len(data)/2; i++ {
+	//循环一层一层的生成节点，知道到最上面的根节点为止。
+	//每一层的节点个数如果是单数的话，就复制最后一个，成为复数
+	for len(nodes) > 1 {
+		if len(nodes) % 2 != 0 {
+			nodes = append(nodes,nodes[len(nodes) - 1])
+		}
 		var newLevel []MerkleNode
 
 		for j := 0; j < len(nodes); j += 2 {
@@ -0,0 +1,248 @@
+package miner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go_code/A_golang_blockchain/block"
+	"go_code/A_golang_blockchain/blockchain"
+	"go_code/A_golang_blockchain/mempool"
+	"go_code/A_golang_blockchain/transaction"
+)
+
+/*
+	矿工：不断根据最新的区块模板挖矿。当有竞争区块成为链的顶端，
+或者交易池发生了足够大的变化时，放弃当前的工作，用新的模板重新开始，
+避免在过时的顶端上浪费算力。
+*/
+
+//返回下一个区块要打包的交易，通常是coinbase交易加上交易池中的交易
+type TemplateFunc func() ([]*transaction.Transaction, error)
+
+//矿工结构体
+type Miner struct {
+	Blockchain *blockchain.Blockchain
+	Template   TemplateFunc
+	//交易池中新增交易达到这个数量时重新生成模板，小于等于0时任何新交易都会触发
+	RestartThreshold int
+
+	mu         sync.Mutex
+	cancel     context.CancelFunc //取消当前这一次挖矿
+	parent     []byte             //当前这一次挖矿所在的顶端
+	pendingTxs int                //当前模板生成后新进入交易池的交易数
+}
+
+//实例化一个矿工，区块由bc的共识引擎封装
+func NewMiner(bc *blockchain.Blockchain, template TemplateFunc) *Miner {
+	return &Miner{Blockchain: bc, Template: template}
+}
+
+//挖出一个区块。当前模板被打断时会自动用新模板重新开始，直到挖出区块或ctx被取消。
+//挖矿期间链的顶端发生变化时会自动打断
+func (m *Miner) MineBlock(ctx context.Context) (*block.Block, error) {
+	tips, unsubscribe := m.Blockchain.SubscribeTip()
+	defer unsubscribe()
+	go func() {
+		for tip := range tips {
+			m.mu.Lock()
+			stale := m.cancel != nil && !bytes.Equal(tip, m.parent)
+			m.mu.Unlock()
+			if stale {
+				m.NotifyNewTip()
+			}
+		}
+	}()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		txs, err := m.Template()
+		if err != nil {
+			return nil, err
+		}
+
+		attempt, cancel := context.WithCancel(ctx)
+		m.mu.Lock()
+		m.cancel = cancel
+		m.parent = m.Blockchain.Tip()
+		m.pendingTxs = 0
+		m.mu.Unlock()
+
+		newBlock, err := m.Blockchain.MineBlock(attempt, txs)
+
+		m.mu.Lock()
+		m.cancel = nil
+		m.mu.Unlock()
+		cancel()
+
+		if err == nil {
+			return newBlock, nil
+		}
+		//外部要求停止
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		//当前模板被打断或者已经过时，重新生成模板
+		if err == context.Canceled || err == blockchain.ErrStaleTip {
+			fmt.Println("区块模板已过时，重新开始挖矿...")
+			continue
+		}
+		return nil, err
+	}
+}
+
+//持续挖矿，blocks为要挖的区块数，小于等于0时一直挖下去，interval为相邻两次挖矿之间的等待时间。
+//每挖出一个区块调用一次onBlock，ctx被取消时正常退出
+func (m *Miner) Run(ctx context.Context, blocks int, interval time.Duration, onBlock func(*block.Block) error) error {
+	for mined := 0; blocks <= 0 || mined < blocks; mined++ {
+		if mined > 0 && interval > 0 {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(interval):
+			}
+		}
+
+		newBlock, err := m.MineBlock(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if onBlock != nil {
+			if err := onBlock(newBlock); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//通知矿工有新的区块成为了链的顶端，正在进行的挖矿立即放弃
+func (m *Miner) NotifyNewTip() {
+	m.interrupt()
+}
+
+//通知矿工交易池新增了n笔交易，累计数量达到RestartThreshold时放弃当前模板
+func (m *Miner) NotifyTransactions(n int) {
+	m.mu.Lock()
+	m.pendingTxs += n
+	material := m.pendingTxs >= m.RestartThreshold
+	m.mu.Unlock()
+
+	if material {
+		m.interrupt()
+	}
+}
+
+//打断正在进行的挖矿
+func (m *Miner) interrupt() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cancel != nil {
+		m.cancel()
+	}
+}
+
+//区块模板中除coinbase以外的交易序列化后的总大小上限(字节)，交易池中的交易放不下时按手续费率挑选
+var MaxTemplateSize = 1 << 20
+
+//根据交易池生成区块模板：一笔奖励给minerAddress的coinbase交易，加上交易池中仍然有效的交易，
+//coinbase交易除了挖矿奖励还得到这些交易的手续费。交易池为空时只打包coinbase交易，
+//引用的输出已经被花费的交易会被移出交易池，花费的coinbase输出还没有成熟的交易留在交易池中等待之后的区块
+func PoolTemplate(minerAddress string, pool mempool.Mempool) TemplateFunc {
+	return func() ([]*transaction.Transaction, error) {
+		coinbase, err := transaction.NewCoinbaseTX(minerAddress, "")
+		if err != nil {
+			return nil, err
+		}
+		tipHeight, err := pool.Blockchain.Height()
+		if err != nil {
+			return nil, err
+		}
+		descs, stale, err := pool.Descs(tipHeight + 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(stale) > 0 {
+			if err := pool.Remove(stale); err != nil {
+				return nil, err
+			}
+		}
+		selected, fees := selectPackages(descs, MaxTemplateSize)
+		coinbase.Vout[0].Value += fees
+		coinbase.ID = coinbase.TxID()
+		return append([]*transaction.Transaction{coinbase}, selected...), nil
+	}
+}
+
+/*
+	按祖先手续费率挑选交易(CPFP)：交易池中的父交易打包之后子交易才能打包，
+所以把一笔交易和它还没有被挑选的祖先看作一个整体，手续费率为整体的手续费之和除以大小之和。
+每次挑选手续费率最高的整体，祖先排在前面，直到放不下为止，
+手续费很高的子交易因此会把手续费很低的父交易一起带进区块。返回挑选的交易和手续费之和
+*/
+func selectPackages(descs []*mempool.TxDesc, maxSize int) ([]*transaction.Transaction, int) {
+	included := make(map[*mempool.TxDesc]bool)
+	skipped := make(map[*mempool.TxDesc]bool)
+	var txs []*transaction.Transaction
+	size, fees := 0, 0
+	for {
+		var best []*mempool.TxDesc
+		bestFee, bestSize := 0, 0
+		for _, desc := range descs {
+			if included[desc] || skipped[desc] {
+				continue
+			}
+			pkg := ancestorPackage(desc, included)
+			pkgFee, pkgSize := 0, 0
+			for _, d := range pkg {
+				pkgFee += d.Fee
+				pkgSize += d.Size
+			}
+			//比较 pkgFee/pkgSize > bestFee/bestSize
+			if best == nil || pkgFee*bestSize > bestFee*pkgSize {
+				best, bestFee, bestSize = pkg, pkgFee, pkgSize
+			}
+		}
+		if best == nil {
+			break
+		}
+		//放不下时跳过这笔交易，它的后代的整体包含它，也放不下
+		if size+bestSize > maxSize {
+			skipped[best[len(best)-1]] = true
+			continue
+		}
+		for _, d := range best {
+			included[d] = true
+			txs = append(txs, d.Tx)
+		}
+		size += bestSize
+		fees += bestFee
+	}
+	return txs, fees
+}
+
+//一笔交易和它还没有被挑选的祖先，父交易排在前面
+func ancestorPackage(desc *mempool.TxDesc, included map[*mempool.TxDesc]bool) []*mempool.TxDesc {
+	var pkg []*mempool.TxDesc
+	seen := make(map[*mempool.TxDesc]bool)
+	var visit func(d *mempool.TxDesc)
+	visit = func(d *mempool.TxDesc) {
+		if included[d] || seen[d] {
+			return
+		}
+		seen[d] = true
+		for _, p := range d.Parents {
+			visit(p)
+		}
+		pkg = append(pkg, d)
+	}
+	visit(desc)
+	return pkg
+}
@@ -0,0 +1,140 @@
+package miner
+
+import (
+	"context"
+	"encoding/hex"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go_code/A_golang_blockchain/block"
+	"go_code/A_golang_blockchain/blockchain"
+	"go_code/A_golang_blockchain/chaincfg"
+	"go_code/A_golang_blockchain/consensus"
+	"go_code/A_golang_blockchain/mempool"
+	"go_code/A_golang_blockchain/transaction"
+	"go_code/A_golang_blockchain/wallet"
+)
+
+//第一次封装一直等到被打断，之后的封装交给内部的引擎
+type blockingEngine struct {
+	consensus.Engine
+	started chan struct{}
+	blocked int32
+}
+
+func (e *blockingEngine) Seal(ctx context.Context, b *block.Block) error {
+	if atomic.CompareAndSwapInt32(&e.blocked, 0, 1) {
+		close(e.started)
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return e.Engine.Seal(ctx, b)
+}
+
+//在regtest上创建一条链，挖到创世区块的coinbase输出成熟为止
+func newTestChain(t *testing.T) (*blockchain.Blockchain, *wallet.Wallets, string) {
+	t.Helper()
+	if err := chaincfg.SetActiveNet("regtest"); err != nil {
+		t.Fatal(err)
+	}
+	ws := &wallet.Wallets{Wallets: map[string]*wallet.Wallet{}}
+	addr, err := ws.CreateWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc, err := blockchain.CreateBlockchain(filepath.Join(t.TempDir(), "chain.db"), addr, consensus.NewDev())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bc.Db().Close() })
+	for i := 0; i < chaincfg.ActiveNetParams.CoinbaseMaturity; i++ {
+		cb, err := transaction.NewCoinbaseTX(addr, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bc.MineBlock(context.Background(), []*transaction.Transaction{cb}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return bc, ws, addr
+}
+
+//花费创世区块的coinbase输出，全部支付给to
+func spendGenesis(t *testing.T, bc *blockchain.Blockchain, ws *wallet.Wallets, to string) *transaction.Transaction {
+	t.Helper()
+	utxos, err := bc.FindUTXO()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for txid, outs := range utxos {
+		for vout, entry := range outs {
+			if entry.Height != 0 {
+				continue
+			}
+			id, _ := hex.DecodeString(txid)
+			raw := transaction.RawTransaction{
+				Tx: transaction.Transaction{
+					Vin:  []transaction.TXInput{{Txid: id, Vout: vout}},
+					Vout: []transaction.TXOutput{*transaction.NewTXOutput(entry.Output.Value, to)},
+				},
+				PrevOuts: []transaction.TXOutput{entry.Output},
+			}
+			if _, err := raw.Sign(ws, transaction.SigHashAll); err != nil {
+				t.Fatal(err)
+			}
+			return &raw.Tx
+		}
+	}
+	t.Fatal("genesis output not found")
+	return nil
+}
+
+//交易放入交易池时，正在进行的挖矿被打断，新的模板包含这笔交易
+func TestNewTransactionRestartsTemplate(t *testing.T) {
+	bc, ws, addr := newTestChain(t)
+	pool := mempool.Mempool{Blockchain: bc}
+	var templates int32
+	template := PoolTemplate(addr, pool)
+	m := NewMiner(bc, func() ([]*transaction.Transaction, error) {
+		atomic.AddInt32(&templates, 1)
+		return template()
+	})
+	pool.OnAdd = func(*transaction.Transaction) {
+		m.NotifyTransactions(1)
+	}
+	engine := &blockingEngine{Engine: consensus.NewDev(), started: make(chan struct{})}
+	bc.SetEngine(engine)
+
+	type result struct {
+		b   *block.Block
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		b, err := m.MineBlock(context.Background())
+		done <- result{b, err}
+	}()
+	<-engine.started
+
+	tx := spendGenesis(t, bc, ws, addr)
+	if err := pool.Add(tx); err != nil {
+		t.Fatal(err)
+	}
+	var r result
+	select {
+	case r = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("mining was not interrupted by the new transaction")
+	}
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if n := atomic.LoadInt32(&templates); n != 2 {
+		t.Fatalf("templates built = %d, want 2", n)
+	}
+	if len(r.b.Transactions) != 2 || string(r.b.Transactions[1].ID) != string(tx.ID) {
+		t.Fatalf("mined block does not contain the new transaction")
+	}
+}
@@ -1,14 +1,20 @@
 package pow
 
 import (
+	"context"
 	"fmt"
 	"crypto/sha256"
 	"strconv"
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"math/big"
 	"go_code/A_golang_blockchain/block"
-	"go_code/A_golang_blockchain/transaction"
+	"go_code/A_golang_blockchain/chaincfg"
 	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 //在实际的比特币区块链中，加入一个区块是非常困难的事情，其中运用得到的就是工作量证明
@@ -17,16 +23,30 @@ import (
 type ProofOfWork struct {
 	block *block.Block //要证明的区块
 	target *big.Int //难度值
+	bits int //挖矿难度，取自当前网络参数
+	txHash []byte //缓存的交易默克尔根，避免在挖矿循环中重复计算
+	witnessHash []byte //缓存的见证默克尔根
+	coinbaseData []byte //coinbase交易原始的附带信息，extra-nonce会追加在它后面
+	hashes uint64 //本次挖矿一共计算的哈希次数
+	elapsed time.Duration //本次挖矿花费的时间
 }
-//声明一个挖矿难度
-const targetBits = 10
+//挖矿难度由当前网络参数chaincfg.ActiveNetParams.TargetBits决定
+
+//nonce空间和extra-nonce都无法继续时返回的错误
+var ErrNonceExhausted = errors.New("nonce space exhausted and block has no coinbase for extra-nonce")
+
+//每个挖矿协程每计算这么多次哈希检查一次是否需要退出，并汇总一次哈希次数
+const checkInterval = 1 << 12
 
 //实例化一个工作量证明
 func NewProofOfWork(b *block.Block) *ProofOfWork {
+	bits := chaincfg.ActiveNetParams.TargetBits
 	target :=  big.NewInt(1)
-	target.Lsh(target,uint(256 - targetBits))
+	target.Lsh(target,uint(256 - bits))
 
-	pow := &ProofOfWork{b,target}
+	pow := &ProofOfWork{block: b, target: target, bits: bits}
+	pow.txHash = b.HashTransactions()
+	pow.witnessHash = b.HashWitnesses()
 	return pow
 }
 
@@ -35,9 +55,10 @@ func (pow *ProofOfWork) prepareData(nonce int) []byte {
 	data := bytes.Join(
 		[][]byte{
 			pow.block.PrevBlockHash,
-			pow.block.HashTransactions(),   //这里被修改，把之前的Data字段修改成交易字段的哈希
+			pow.txHash,   //这里被修改，把之前的Data字段修改成交易字段的哈希
+			pow.witnessHash,
 			[]byte(strconv.FormatInt(pow.block.Timestamp,10)),
-			[]byte(strconv.FormatInt(targetBits,10)),
+			[]byte(strconv.FormatInt(int64(pow.bits),10)),
 			[]byte(strconv.FormatInt(int64(nonce),10)),
 		},
 		[]byte{},
@@ -47,37 +68,144 @@ func (pow *ProofOfWork) prepareData(nonce int) []byte {
 
 //进行工作量证明,证明成功会返回随机数和区块哈希
 func (pow *ProofOfWork) Run() (int,[]byte) {
-	nonce := 0
+	nonce,hash,_ := pow.RunParallel(context.Background(),1)
+	return nonce,hash
+}
+
+//挖矿协程找到的结果
+type result struct {
+	nonce int
+	hash  []byte
+}
+
+//多协程进行工作量证明，threads个协程把nonce空间按步长threads分割，
+//任意一个协程找到结果后通知其余协程退出。如果64位的nonce空间被用完，
+//就增加coinbase交易中的extra-nonce，重新计算默克尔根后继续。
+//ctx被取消时所有协程立即退出，返回ctx.Err()
+func (pow *ProofOfWork) RunParallel(ctx context.Context,threads int) (int,[]byte,error) {
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+	start := time.Now()
+	atomic.StoreUint64(&pow.hashes, 0)
+
+	for extraNonce := uint64(0); ; extraNonce++ {
+		if err := ctx.Err(); err != nil {
+			pow.elapsed = time.Since(start)
+			return 0,nil,err
+		}
+		if extraNonce > 0 && !pow.setExtraNonce(extraNonce) {
+			break
+		}
+
+		found := make(chan result, threads)
+		quit := make(chan struct{})
+		var wg sync.WaitGroup
+
+		for i := 0; i < threads; i++ {
+			wg.Add(1)
+			go func(first int) {
+				defer wg.Done()
+				pow.mine(ctx, first, threads, quit, found)
+			}(i)
+		}
+
+		var res *result
+		go func() {
+			wg.Wait()
+			close(found)
+		}()
+		//第一个找到的结果有效，其余协程直接退出
+		if r, ok := <-found; ok {
+			res = &r
+		}
+		close(quit)
+		wg.Wait()
+
+		if res != nil {
+			pow.elapsed = time.Since(start)
+			fmt.Printf("工作量证明成功 hash= %x  nonce = %v  extraNonce = %v\n",res.hash,res.nonce,extraNonce)
+			fmt.Printf("协程数 %d, 共计算 %d 次哈希, 算力 %.2f kH/s\n",threads,pow.Hashes(),pow.Hashrate()/1000)
+			fmt.Println()
+			return res.nonce,res.hash,nil
+		}
+	}
+
+	pow.elapsed = time.Since(start)
+	return 0,nil,ErrNonceExhausted
+}
+
+//单个挖矿协程，从first开始以step为步长尝试nonce
+func (pow *ProofOfWork) mine(ctx context.Context, first, step int, quit <-chan struct{}, found chan<- result) {
 	var hash [32]byte
 	var hashInt big.Int
-	for nonce < math.MaxInt64 {
+	counted := 0
+
+	for nonce := first; ; nonce += step {
 		data := pow.prepareData(nonce)
 		hash = sha256.Sum256(data)
 		hashInt.SetBytes(hash[:])
+		counted++
 
 		//把哈希后的数据与难度值进行比较
 		if hashInt.Cmp(pow.target) == -1 {
-			fmt.Printf("工作量证明成功 hash= %x  nonce = %v\n",hash,nonce)
-			break
-		}else{
-			nonce ++
+			atomic.AddUint64(&pow.hashes, uint64(counted))
+			found <- result{nonce, append([]byte{}, hash[:]...)}
+			return
+		}
+
+		if counted == checkInterval {
+			atomic.AddUint64(&pow.hashes, uint64(counted))
+			counted = 0
+			select {
+			case <-quit:
+				return
+			case <-ctx.Done():
+				return
+			default:
+			}
+		}
+
+		//nonce空间用完
+		if nonce > math.MaxInt64 - step {
+			atomic.AddUint64(&pow.hashes, uint64(counted))
+			return
 		}
 	}
-	fmt.Println()
+}
+
+//修改coinbase交易中的extra-nonce，并重新计算交易ID和两个默克尔根
+func (pow *ProofOfWork) setExtraNonce(extraNonce uint64) bool {
+	if len(pow.block.Transactions) == 0 || !pow.block.Transactions[0].IsCoinbase() {
+		return false
+	}
+	coinbase := pow.block.Transactions[0]
+	if pow.coinbaseData == nil {
+		pow.coinbaseData = append([]byte{}, coinbase.Vin[0].PubKey...)
+	}
 
-	return nonce,hash[:]
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, extraNonce)
+	coinbase.Vin[0].PubKey = append(append([]byte{}, pow.coinbaseData...), buf...)
+	coinbase.ID = coinbase.TxID()
+	pow.txHash = pow.block.HashTransactions()
+	pow.witnessHash = pow.block.HashWitnesses()
+
+	return true
 }
 
-//实例化一个区块    /更改data为transaction/
-func NewBlock(transactions	[]*transaction.Transaction,prevBlockHash []byte) *block.Block {
-	block := &block.Block{time.Now().Unix(),transactions,prevBlockHash,[]byte{},0}
-	// block.SetHash()
+//返回最近一次挖矿计算的哈希次数
+func (pow *ProofOfWork) Hashes() uint64 {
+	return atomic.LoadUint64(&pow.hashes)
+}
 
-	pow := NewProofOfWork(block)
-	nonce,hash := pow.Run()
-	block.Hash = hash
-	block.Nonce = nonce
-	return block
+//返回最近一次挖矿的算力，单位为 哈希/秒
+func (pow *ProofOfWork) Hashrate() float64 {
+	seconds := pow.elapsed.Seconds()
+	if seconds == 0 {
+		return 0
+	}
+	return float64(pow.Hashes()) / seconds
 }
 
 //其他节点验证nonce是否正确
@@ -88,6 +216,10 @@ func (pow *ProofOfWork) Validate() bool {
 	hash := sha256.Sum256(data)
 	hashInt.SetBytes(hash[:])
 
+	//区块中保存的哈希必须就是重新计算出来的哈希，否则可以伪造区块哈希
+	if !bytes.Equal(hash[:],pow.block.Hash) {
+		return false
+	}
 	isValid := hashInt.Cmp(pow.target) == -1 
 	return isValid
 }
@@ -0,0 +1,40 @@
+package pow
+
+import (
+	"context"
+	"testing"
+
+	"go_code/A_golang_blockchain/block"
+	"go_code/A_golang_blockchain/chaincfg"
+	"go_code/A_golang_blockchain/transaction"
+)
+
+//区块中保存的哈希与重新计算的哈希不一致时，工作量证明无效
+func TestValidateChecksStoredHash(t *testing.T) {
+	if err := chaincfg.SetActiveNet("regtest"); err != nil {
+		t.Fatal(err)
+	}
+	cb := &transaction.Transaction{
+		Vin:  []transaction.TXInput{{Vout: -1, PubKey: []byte("pow test")}},
+		Vout: []transaction.TXOutput{{Value: 50, PubkeyHash: make([]byte, 20)}},
+	}
+	cb.ID = cb.TxID()
+	b := block.NewBlock([]*transaction.Transaction{cb}, []byte{})
+	nonce, hash, err := NewProofOfWork(b).RunParallel(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Nonce, b.Hash = nonce, hash
+	if !NewProofOfWork(b).Validate() {
+		t.Fatal("sealed block does not validate")
+	}
+
+	b.Hash = make([]byte, len(hash))
+	if NewProofOfWork(b).Validate() {
+		t.Fatal("block with a forged hash validates")
+	}
+	b.Hash = nil
+	if NewProofOfWork(b).Validate() {
+		t.Fatal("block without a hash validates")
+	}
+}
@@ -0,0 +1,309 @@
+package schnorr
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"math/bits"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
+
+/*
+	secp256k1上的Schnorr签名，按BIP 340：公钥是32字节的x坐标(y取偶数)，
+签名是64字节的 R.x || s，验证 s*G = R + e*P，其中 e = H(R.x || P.x || m)。
+签名的随机数由私钥和消息确定(辅助随机数取全0)，同一私钥对同一消息的签名总是相同。
+Schnorr签名的验证方程是线性的，多个签名可以用随机系数合并成一个方程一起验证，见BatchVerifier
+*/
+
+const (
+	PubKeyLen = 32 //x坐标
+	SignatureLen = 64 //R.x || s
+	minBatchSize = 16 //少于这么多签名时逐个验证
+)
+
+var (
+	//公钥不是曲线上的点的x坐标
+	ErrInvalidPubKey = errors.New("schnorr: public key is not valid")
+	//私钥为0，或者随机数为0(概率可以忽略)
+	ErrInvalidPrivateKey = errors.New("schnorr: private key is not valid")
+)
+
+//BIP 340中带标签的哈希：SHA256(SHA256(tag) || SHA256(tag) || data...)
+func taggedHash(tag string,data ...[]byte) [32]byte {
+	tagHash := sha256.Sum256([]byte(tag))
+	h := sha256.New()
+	h.Write(tagHash[:])
+	h.Write(tagHash[:])
+	for _,d := range data {
+		h.Write(d)
+	}
+	var out [32]byte
+	h.Sum(out[:0])
+	return out
+}
+
+//e = H(R.x || P.x || m) mod N
+func challenge(r,pubKey,msg []byte) secp256k1.ModNScalar {
+	hash := taggedHash("BIP0340/challenge",r,pubKey,msg)
+	var e secp256k1.ModNScalar
+	e.SetBytes(&hash)
+	return e
+}
+
+//由x坐标得到y为偶数的点
+func liftX(x []byte) (secp256k1.JacobianPoint,bool) {
+	var p secp256k1.JacobianPoint
+	if len(x) != 32 || p.X.SetByteSlice(x) {
+		return p,false
+	}
+	if !secp256k1.DecompressY(&p.X,false,&p.Y) {
+		return p,false
+	}
+	p.Y.Normalize()
+	p.Z.SetInt(1)
+	return p,true
+}
+
+//公钥的32字节编码
+func SerializePubKey(pubKey *secp256k1.PublicKey) []byte {
+	return pubKey.SerializeCompressed()[1:]
+}
+
+//检查公钥是否为曲线上的点的x坐标
+func ParsePubKey(pubKey []byte) error {
+	if _,ok := liftX(pubKey); !ok {
+		return ErrInvalidPubKey
+	}
+	return nil
+}
+
+//用私钥对消息签名
+func Sign(privKey *secp256k1.PrivateKey,msg []byte) ([]byte,error) {
+	d := privKey.Key
+	if d.IsZero() {
+		return nil,ErrInvalidPrivateKey
+	}
+	var p secp256k1.JacobianPoint
+	secp256k1.ScalarBaseMultNonConst(&d,&p)
+	p.ToAffine()
+	//公钥只保留x坐标，对应的是y为偶数的点，y为奇数时私钥取反
+	if p.Y.IsOdd() {
+		d.Negate()
+	}
+	pBytes := p.X.Bytes()
+	dBytes := d.Bytes()
+
+	var zero [32]byte
+	aux := taggedHash("BIP0340/aux",zero[:])
+	var t [32]byte
+	for i := range t {
+		t[i] = dBytes[i]^aux[i]
+	}
+	nonce := taggedHash("BIP0340/nonce",t[:],pBytes[:],msg)
+	var k secp256k1.ModNScalar
+	k.SetBytes(&nonce)
+	if k.IsZero() {
+		return nil,ErrInvalidPrivateKey
+	}
+	var r secp256k1.JacobianPoint
+	secp256k1.ScalarBaseMultNonConst(&k,&r)
+	r.ToAffine()
+	if r.Y.IsOdd() {
+		k.Negate()
+	}
+	rBytes := r.X.Bytes()
+
+	e := challenge(rBytes[:],pBytes[:],msg)
+	var s secp256k1.ModNScalar
+	s.Mul2(&e,&d).Add(&k)
+	sBytes := s.Bytes()
+	return append(rBytes[:],sBytes[:]...),nil
+}
+
+//解析签名中的R和s，R.x不小于P或者s不小于N时返回false
+func parseSignature(sig []byte) (secp256k1.JacobianPoint,secp256k1.ModNScalar,bool) {
+	var s secp256k1.ModNScalar
+	if len(sig) != SignatureLen {
+		return secp256k1.JacobianPoint{},s,false
+	}
+	r,ok := liftX(sig[:32])
+	if !ok || s.SetByteSlice(sig[32:]) {
+		return r,s,false
+	}
+	return r,s,true
+}
+
+//验证一个签名：s*G - e*P 必须是x坐标为R.x、y为偶数的点
+func Verify(pubKey,msg,sig []byte) bool {
+	p,ok := liftX(pubKey)
+	if !ok || len(sig) != SignatureLen {
+		return false
+	}
+	var r secp256k1.FieldVal
+	var s secp256k1.ModNScalar
+	if r.SetByteSlice(sig[:32]) || s.SetByteSlice(sig[32:]) {
+		return false
+	}
+	e := challenge(sig[:32],pubKey,msg)
+	e.Negate()
+
+	var sG,eP,R secp256k1.JacobianPoint
+	secp256k1.ScalarBaseMultNonConst(&s,&sG)
+	secp256k1.ScalarMultNonConst(&e,&p,&eP)
+	secp256k1.AddNonConst(&sG,&eP,&R)
+	if isInfinity(&R) {
+		return false
+	}
+	R.ToAffine()
+	return !R.Y.IsOdd() && R.X.Equals(&r)
+}
+
+func isInfinity(p *secp256k1.JacobianPoint) bool {
+	return (p.X.IsZero() && p.Y.IsZero()) || p.Z.IsZero()
+}
+
+/*
+	批量验证：对n个签名取随机系数a1=1, a2..an，验证
+	(a1*s1 + ... + an*sn)*G = a1*R1 + ... + an*Rn + (a1*e1)*P1 + ... + (an*en)*Pn。
+只要有一个签名无效，等式成立的概率可以忽略。等式右边的2n个点乘用Pippenger算法一起计算，
+所有点共用倍点运算，n较大时比逐个验证快很多；签名少于minBatchSize个时合并反而更慢，直接逐个验证。
+批量验证失败时不能确定是哪个签名无效，需要的话再逐个调用Verify
+*/
+type BatchVerifier struct {
+	entries []batchEntry
+}
+
+type batchEntry struct {
+	pubKey	[]byte
+	msg	[]byte
+	sig	[]byte
+}
+
+func NewBatchVerifier() *BatchVerifier {
+	return &BatchVerifier{}
+}
+
+//加入一个待验证的签名
+func (bv *BatchVerifier) Add(pubKey,msg,sig []byte) {
+	bv.entries = append(bv.entries,batchEntry{pubKey,msg,sig})
+}
+
+//待验证的签名数量
+func (bv *BatchVerifier) Len() int {
+	return len(bv.entries)
+}
+
+//验证加入的所有签名，全部有效时返回true，没有签名时也返回true
+func (bv *BatchVerifier) Verify() bool {
+	n := len(bv.entries)
+	if n < minBatchSize {
+		return bv.verifyEach()
+	}
+	coeffs := make([]byte,16*n)
+	if _,err := rand.Read(coeffs); err != nil {
+		//取不到随机数时退回到逐个验证
+		return bv.verifyEach()
+	}
+
+	scalars := make([]secp256k1.ModNScalar,0,2*n)
+	points := make([]secp256k1.JacobianPoint,0,2*n)
+	var sSum secp256k1.ModNScalar
+	for i,entry := range bv.entries {
+		p,ok := liftX(entry.pubKey)
+		if !ok {
+			return false
+		}
+		r,s,ok := parseSignature(entry.sig)
+		if !ok {
+			return false
+		}
+		e := challenge(entry.sig[:32],entry.pubKey,entry.msg)
+
+		//128位的随机系数足以让伪造的签名通过验证的概率可以忽略
+		var a secp256k1.ModNScalar
+		if i == 0 {
+			a.SetInt(1)
+		} else {
+			var buf [32]byte
+			copy(buf[16:],coeffs[16*i:16*(i+1)])
+			a.SetBytes(&buf)
+		}
+		sSum.Add(new(secp256k1.ModNScalar).Mul2(&a,&s))
+		scalars = append(scalars,a,*e.Mul(&a))
+		points = append(points,r,p)
+	}
+
+	var lhs,rhs secp256k1.JacobianPoint
+	secp256k1.ScalarBaseMultNonConst(&sSum,&lhs)
+	multiScalarMult(scalars,points,&rhs)
+	if isInfinity(&lhs) || isInfinity(&rhs) {
+		return isInfinity(&lhs) && isInfinity(&rhs)
+	}
+	lhs.ToAffine()
+	rhs.ToAffine()
+	return lhs.X.Equals(&rhs.X) && lhs.Y.Equals(&rhs.Y)
+}
+
+//逐个验证加入的签名
+func (bv *BatchVerifier) verifyEach() bool {
+	for _,e := range bv.entries {
+		if !Verify(e.pubKey,e.msg,e.sig) {
+			return false
+		}
+	}
+	return true
+}
+
+//用Pippenger算法计算 k1*P1 + ... + kn*Pn：标量按c位分成若干窗口，
+//每个窗口把点按该窗口的值放进桶里，再用一次累加求出各桶的加权和
+func multiScalarMult(scalars []secp256k1.ModNScalar,points []secp256k1.JacobianPoint,result *secp256k1.JacobianPoint) {
+	c := bits.Len(uint(len(points)))-3
+	if c < 2 {
+		c = 2
+	} else if c > 12 {
+		c = 12
+	}
+	scalarBytes := make([][32]byte,len(scalars))
+	for i := range scalars {
+		scalarBytes[i] = scalars[i].Bytes()
+	}
+
+	*result = secp256k1.JacobianPoint{}
+	buckets := make([]secp256k1.JacobianPoint,1<<uint(c)-1)
+	for w := (256+c-1)/c-1; w >= 0; w-- {
+		for i := 0; i < c; i++ {
+			secp256k1.DoubleNonConst(result,result)
+		}
+		for i := range buckets {
+			buckets[i] = secp256k1.JacobianPoint{}
+		}
+		for i := range points {
+			idx := window(&scalarBytes[i],w*c,c)
+			if idx != 0 {
+				secp256k1.AddNonConst(&buckets[idx-1],&points[i],&buckets[idx-1])
+			}
+		}
+		//sum = 1*B1 + 2*B2 + ... ，从高到低累加：running = Bj + ... + Bmax，sum为各running之和
+		var running,sum secp256k1.JacobianPoint
+		for j := len(buckets)-1; j >= 0; j-- {
+			secp256k1.AddNonConst(&running,&buckets[j],&running)
+			secp256k1.AddNonConst(&sum,&running,&sum)
+		}
+		secp256k1.AddNonConst(result,&sum,result)
+	}
+}
+
+//取大端序标量从第start位(最低位为第0位)开始的c位
+func window(b *[32]byte,start,c int) int {
+	idx := 0
+	for i := 0; i < c; i++ {
+		pos := start+i
+		if pos >= 256 {
+			break
+		}
+		bit := int(b[31-pos/8]>>uint(pos%8))&1
+		idx |= bit<<uint(i)
+	}
+	return idx
+}
@@ -0,0 +1,162 @@
+package schnorr
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
+
+func decodeHex(t testing.TB,s string) []byte {
+	t.Helper()
+	b,err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+//BIP 340测试向量0：辅助随机数为全0，和Sign使用的相同
+func TestSignBIP340Vector(t *testing.T) {
+	key := secp256k1.PrivKeyFromBytes(decodeHex(t,"0000000000000000000000000000000000000000000000000000000000000003"))
+	msg := make([]byte,32)
+	wantPubKey := decodeHex(t,"F9308A019258C31049344F85F89D5229B531C845836F99B08601F113BCE036F9")
+	wantSig := decodeHex(t,"E907831F80848D1069A5371B402410364BDF1C5F8307B0084C55F1CE2DCA821525F66A4A85EA8B71E482A74F382D2CE5EBEEE8FDB2172F477DF4900D310536C0")
+
+	if pubKey := SerializePubKey(key.PubKey()); !bytes.Equal(pubKey,wantPubKey) {
+		t.Fatalf("public key = %X, want %X",pubKey,wantPubKey)
+	}
+	sig,err := Sign(key,msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sig,wantSig) {
+		t.Fatalf("signature = %X, want %X",sig,wantSig)
+	}
+	if !Verify(wantPubKey,msg,sig) {
+		t.Fatal("signature does not verify")
+	}
+}
+
+//BIP 340只用于验证的测试向量
+func TestVerifyBIP340Vectors(t *testing.T) {
+	tests := []struct {
+		index int
+		pubKey,msg,sig string
+		valid bool
+	}{
+		{
+			index: 4,
+			pubKey: "D69C3509BB99E412E68B0FE8544E72837DFA30746D8BE2AA65975F29D22DC7B9",
+			msg: "4DF3C3F68FCC83B27E9D42C90431A72499F17875C81A599B566C9889B9696703",
+			sig: "00000000000000000000003B78CE563F89A0ED9414F5AA28AD0D96D6795F9C6376AFB1548AF603B3EB45C9F8207DEE1060CB71C04E80F593060B07D28308D7F4",
+			valid: true,
+		},
+		{
+			//R的y坐标为奇数
+			index: 6,
+			pubKey: "DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659",
+			msg: "243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+			sig: "FFF97BD5755EEEA420453A14355235D382F6472F8568A18B2F057A14602975563CC27944640AC607CD107AE10923D9EF7A73C643E166BE5EBEAFA34B1AC553E2",
+			valid: false,
+		},
+	}
+	for _,tt := range tests {
+		pubKey,msg,sig := decodeHex(t,tt.pubKey),decodeHex(t,tt.msg),decodeHex(t,tt.sig)
+		if got := Verify(pubKey,msg,sig); got != tt.valid {
+			t.Errorf("vector %d: Verify = %v, want %v",tt.index,got,tt.valid)
+		}
+		bv := NewBatchVerifier()
+		bv.Add(pubKey,msg,sig)
+		if got := bv.Verify(); got != tt.valid {
+			t.Errorf("vector %d: BatchVerifier.Verify = %v, want %v",tt.index,got,tt.valid)
+		}
+	}
+}
+
+//一批签名中只要有一个无效，批量验证就失败
+func TestBatchVerifyRejectsOneInvalid(t *testing.T) {
+	sigs := testSigs(t,17)
+	bv := NewBatchVerifier()
+	for _,s := range sigs {
+		bv.Add(s.pubKey,s.msg,s.sig)
+	}
+	if !bv.Verify() {
+		t.Fatal("valid batch does not verify")
+	}
+
+	for _,bad := range []int{0,8,16} {
+		bv := NewBatchVerifier()
+		for i,s := range sigs {
+			msg := s.msg
+			if i == bad {
+				//签名对另一条消息无效
+				msg = sigs[(i+1)%len(sigs)].msg
+			}
+			bv.Add(s.pubKey,msg,s.sig)
+		}
+		if bv.Verify() {
+			t.Errorf("batch with invalid signature %d verifies",bad)
+		}
+	}
+}
+
+type testSig struct {
+	pubKey,msg,sig []byte
+}
+
+//生成n个不同私钥对不同消息的签名
+func testSigs(t testing.TB,n int) []testSig {
+	t.Helper()
+	sigs := make([]testSig,n)
+	for i := range sigs {
+		key,err := secp256k1.GeneratePrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := sha256.Sum256([]byte(fmt.Sprintf("test %d",i)))
+		sig,err := Sign(key,msg[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sigs[i] = testSig{SerializePubKey(key.PubKey()),msg[:],sig}
+	}
+	return sigs
+}
+
+func BenchmarkBatchVerify(b *testing.B) {
+	for _,n := range []int{16,64,256} {
+		b.Run(fmt.Sprintf("n=%d",n),func(b *testing.B) {
+			sigs := testSigs(b,n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				bv := NewBatchVerifier()
+				for _,s := range sigs {
+					bv.Add(s.pubKey,s.msg,s.sig)
+				}
+				if !bv.Verify() {
+					b.Fatal("batch verification failed")
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkVerifyEach(b *testing.B) {
+	for _,n := range []int{16,64,256} {
+		b.Run(fmt.Sprintf("n=%d",n),func(b *testing.B) {
+			sigs := testSigs(b,n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _,s := range sigs {
+					if !Verify(s.pubKey,s.msg,s.sig) {
+						b.Fatal("verification failed")
+					}
+				}
+			}
+		})
+	}
+}
@@ -2,22 +2,24 @@ package transaction
 
 import (
 	"strings"
-	"math/big"
-	"crypto/elliptic"
 	"encoding/hex"
-	"crypto/ecdsa"
 	"crypto/sha256"
 	"crypto/rand"
 	"encoding/gob"
+	"encoding/json"
 	"bytes"
+	"errors"
 	"fmt"
-	"log"
 	"go_code/A_golang_blockchain/wallet"
 	"go_code/A_golang_blockchain/base58"
+	"go_code/A_golang_blockchain/chaincfg"
 	
 )
 
-var subsidy int = 50  //挖矿奖励
+//挖矿奖励由当前网络参数chaincfg.ActiveNetParams.Subsidy决定
+
+//输入引用的交易或输出不存在
+var ErrPrevTxNotFound = errors.New("previous transaction is not correct")
 /*创建一个交易的数据结构，交易是由交易ID、交易输入、交易输出组成的,
 一个交易有多个输入和多个输出，所以这里的交易输入和输出应该是切片类型的
 */ 
@@ -25,6 +27,7 @@ type Transaction struct {
 	ID		[]byte
 	Vin		[]TXInput
 	Vout	[]TXOutput
+	Replaceable	bool //交易还没确认时，允许被花费相同输出并且手续费更高的交易替换(RBF)
 }
 
 /*
@@ -58,23 +61,29 @@ type TXInput struct {
 */
 //现在我们来创建一个这样的coinbase挖矿输出
 //to 代表此输出奖励给谁，一般都是矿工地址，data是交易附带的信息
-func NewCoinbaseTX(to,data string) *Transaction {
+func NewCoinbaseTX(to,data string) (*Transaction,error) {
 	if data == "" {
-		data = fmt.Sprintf("奖励给 '%s'",to)
+		//加入随机数据，避免同一地址在不同区块中的coinbase交易ID相同
+		randData := make([]byte,8)
+		_,err := rand.Read(randData)
+		if err != nil {
+			return nil,err
+		}
+		data = fmt.Sprintf("奖励给 '%s' %x",to,randData)
 	}
 	//此交易中的交易输入,没有交易输入信息
 	//txin := TXInput{[]byte{},-1,[]byte{},}
 	txin := TXInput{[]byte{},-1,nil,[]byte(data)}
-	//交易输出,subsidy为奖励矿工的币的数量
-	txout := NewTXOutput(subsidy,to)
+	//交易输出,Subsidy为奖励矿工的币的数量
+	txout := NewTXOutput(chaincfg.ActiveNetParams.Subsidy,to)
 	//组成交易
 	//tx := Transaction{nil,[]TXInput{txin},[]TXOutput{txout}}
-	tx := Transaction{nil,[]TXInput{txin},[]TXOutput{*txout}}
+	tx := Transaction{nil,[]TXInput{txin},[]TXOutput{*txout},false}
 
 	//设置该交易的ID
 	//tx.SetID()
-	tx.ID = tx.Hash()
-	return &tx
+	tx.ID = tx.TxID()
+	return &tx,nil
 }
 
 ////设置交易ID，交易ID是序列化tx后再哈希
@@ -85,14 +94,24 @@ func (tx Transaction) Serialize() []byte {
 	var encoder bytes.Buffer
 
 	enc := gob.NewEncoder(&encoder)
+	//编码固定的结构体不会失败，失败说明是程序错误
 	err := enc.Encode(tx)
 	if err != nil {
-		log.Panic(err)
+		panic(err)
 	}
 	//hash = sha256.Sum256(encoder.Bytes())
 	//tx.ID =  hash[:]
 	return encoder.Bytes()
 }
+//反序列化一个交易
+func DeserializeTransaction(data []byte) (Transaction,error) {
+	var transaction Transaction
+
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&transaction)
+	return transaction,err
+}
+
 //返回交易的哈希值
 func (tx *Transaction) Hash() []byte {
 	var hash [32]byte
@@ -105,6 +124,40 @@ func (tx *Transaction) Hash() []byte {
 	return hash[:]
 }
 
+/*
+	交易ID只对非见证数据(各输入引用的输出和交易输出)做哈希，不包含签名和公钥：
+签名和公钥的编码可以被第三方修改而交易仍然有效，如果ID包含它们，别人就能改掉还没确认的交易的ID，
+花费它的输出的后续交易就失效了。coinbase输入的PubKey字段存放附带信息和extra-nonce，不是见证数据，保留在ID中
+*/
+func (tx *Transaction) TxID() []byte {
+	txCopy := Transaction{nil,make([]TXInput,len(tx.Vin)),tx.Vout,tx.Replaceable}
+	for i,vin := range tx.Vin {
+		txCopy.Vin[i] = TXInput{vin.Txid,vin.Vout,nil,nil}
+	}
+	if tx.IsCoinbase() {
+		txCopy.Vin[0].PubKey = tx.Vin[0].PubKey
+	}
+	return txCopy.Hash()
+}
+
+//见证哈希：包含签名和公钥的完整交易的哈希，区块通过它承诺交易的见证数据
+func (tx *Transaction) WitnessHash() []byte {
+	return tx.Hash()
+}
+
+//手续费：各输入引用的输出(prevOuts，和Vin一一对应)的金额之和减去交易输出的金额之和，
+//手续费归打包该交易的矿工。结果为负数的交易是无效的
+func (tx *Transaction) Fee(prevOuts []TXOutput) int {
+	fee := 0
+	for _,out := range prevOuts {
+		fee += out.Value
+	}
+	for _,out := range tx.Vout {
+		fee -= out.Value
+	}
+	return fee
+}
+
 /*
 1、每一个区块至少存储一笔coinbase交易，所以我们在区块的字段中把Data字段换成交易。
 2、把所有涉及之前Data字段都要换了，比如NewBlock()、GenesisBlock()、pow里的函数
@@ -151,80 +204,243 @@ func (tx *Transaction) IsCoinbase() bool {
 	return len(tx.Vin) == 1 && len(tx.Vin[0].Txid) == 0 && tx.Vin[0].Vout == -1
 }
 
-//对交易签名
-func (tx *Transaction) Sign(privKey ecdsa.PrivateKey,prevTXs map[string]Transaction) {
-	if tx.IsCoinbase() {
-		return
-	} 
+/*
+	签名哈希类型：附加在签名后面的一个字节，决定签名覆盖交易的哪些部分。
+SigHashAll覆盖所有输入和输出；SigHashNone不覆盖输出，输出可以由其他人决定；
+SigHashSingle只覆盖和该输入序号相同的那个输出；再加上SigHashAnyOneCanPay时只覆盖该输入自己，
+其他人可以继续加入输入，例如多人一起凑钱支付同一个输出。
+旧版本的签名后面没有类型字节，按SigHashAll验证，签名的哈希中也不包括类型
+*/
+type SigHashType byte
 
-	for _,vin := range tx.Vin {
-		if prevTXs[hex.EncodeToString(vin.Txid)].ID == nil {
-			log.Panic("ERROR: Previous transaction is not correct")
+const (
+	SigHashAll SigHashType = 0x01
+	SigHashNone SigHashType = 0x02
+	SigHashSingle SigHashType = 0x03
+	SigHashAnyOneCanPay SigHashType = 0x80
+
+	sigHashLegacy SigHashType = 0 //没有类型字节的旧签名
+)
+
+var (
+	//签名哈希类型不是上面的组合
+	ErrInvalidSigHashType = errors.New("invalid signature hash type")
+	//SigHashSingle的输入没有序号相同的输出
+	ErrSigHashSingle = errors.New("SIGHASH_SINGLE input has no matching output")
+	//输入中的公钥不是引用的输出锁定的公钥
+	ErrWrongKey = errors.New("input public key does not match the locked output")
+)
+
+//签名哈希类型的名称，例如 ALL、SINGLE|ANYONECANPAY
+func (t SigHashType) String() string {
+	var name string
+	switch t &^ SigHashAnyOneCanPay {
+	case SigHashAll:
+		name = "ALL"
+	case SigHashNone:
+		name = "NONE"
+	case SigHashSingle:
+		name = "SINGLE"
+	default:
+		return fmt.Sprintf("SigHashType(%#x)",byte(t))
+	}
+	if t&SigHashAnyOneCanPay != 0 {
+		name += "|ANYONECANPAY"
+	}
+	return name
+}
+
+//是否为有效的签名哈希类型
+func (t SigHashType) valid() bool {
+	base := t &^ SigHashAnyOneCanPay
+	return base >= SigHashAll && base <= SigHashSingle
+}
+
+//通过名称得到签名哈希类型，不区分大小写，例如 all、none|anyonecanpay
+func ParseSigHashType(name string) (SigHashType,error) {
+	var base,anyoneCanPay SigHashType
+	for _,part := range strings.Split(strings.ToUpper(name),"|") {
+		var t SigHashType
+		switch strings.TrimSpace(part) {
+		case "ALL":
+			t = SigHashAll
+		case "NONE":
+			t = SigHashNone
+		case "SINGLE":
+			t = SigHashSingle
+		case "ANYONECANPAY":
+			if anyoneCanPay != 0 {
+				return 0,fmt.Errorf("%w: %s",ErrInvalidSigHashType,name)
+			}
+			anyoneCanPay = SigHashAnyOneCanPay
+			continue
+		default:
+			return 0,fmt.Errorf("%w: %s",ErrInvalidSigHashType,name)
+		}
+		//只能有一个基本类型
+		if base != 0 {
+			return 0,fmt.Errorf("%w: %s",ErrInvalidSigHashType,name)
+		}
+		base = t
+	}
+	if base == 0 {
+		return 0,fmt.Errorf("%w: %s",ErrInvalidSigHashType,name)
+	}
+	return base|anyoneCanPay,nil
+}
+
+//把输入中的签名分成签名本身和签名哈希类型，旧版本的签名返回sigHashLegacy
+func splitSignature(sig []byte) ([]byte,SigHashType,error) {
+	switch len(sig) {
+	case wallet.SignatureLen:
+		return sig,sigHashLegacy,nil
+	case wallet.SignatureLen+1:
+		t := SigHashType(sig[wallet.SignatureLen])
+		if !t.valid() {
+			return nil,0,ErrInvalidSigHashType
 		}
+		return sig[:wallet.SignatureLen],t,nil
 	}
-	txCopy := tx.TrimmedCopy()
+	return nil,0,fmt.Errorf("%w: signature length %d",ErrInvalidSigHashType,len(sig))
+}
 
-	for inID,vin := range txCopy.Vin {
-		prevTx := prevTXs[hex.EncodeToString(vin.Txid)]
-		txCopy.Vin[inID].Signature = nil
-		txCopy.Vin[inID].PubKey = prevTx.Vout[vin.Vout].PubkeyHash
-		txCopy.ID = txCopy.Hash()
-		txCopy.Vin[inID].PubKey = nil
+//对交易的所有输入签名，签名覆盖整个交易(SigHashAll)
+func (tx *Transaction) Sign(privKey wallet.PrivateKey,prevTXs map[string]Transaction) error {
+	if tx.IsCoinbase() {
+		return nil
+	} 
 
-		r,s,err := ecdsa.Sign(rand.Reader,&privKey,txCopy.ID)
+	if err := checkPrevTXs(tx,prevTXs); err != nil {
+		return err
+	}
+	for inID,vin := range tx.Vin {
+		prevTx := prevTXs[hex.EncodeToString(vin.Txid)]
+		err := tx.SignInput(inID,privKey,prevTx.Vout[vin.Vout],SigHashAll)
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
-		signature := append(r.Bytes(),s.Bytes()...)
+	}
+	return nil
+}
 
-		tx.Vin[inID].Signature = signature
+//输入inID签名的数据：按签名哈希类型修剪后的副本(见TrimmedCopy)的哈希，再和类型一起取哈希
+func (tx *Transaction) sigHash(inID int,prevOut TXOutput,hashType SigHashType) ([]byte,error) {
+	txCopy,err := tx.TrimmedCopy(inID,hashType)
+	if err != nil {
+		return nil,err
+	}
+	//SigHashAnyOneCanPay的副本中只剩下这一个输入
+	signing := inID
+	if hashType&SigHashAnyOneCanPay != 0 {
+		signing = 0
 	}
+	txCopy.Vin[signing].PubKey = prevOut.PubkeyHash
+	hash := txCopy.Hash()
+	if hashType == sigHashLegacy {
+		return hash,nil
+	}
+	typed := sha256.Sum256(append(hash,byte(hashType)))
+	return typed[:],nil
+}
 
+//用私钥对第inID个输入签名，prevOut为该输入引用的输出，hashType为签名覆盖的范围。
+//签名算法由私钥的类型决定，签名都是确定性的，签名后面附加一个字节的hashType
+func (tx *Transaction) SignInput(inID int,privKey wallet.PrivateKey,prevOut TXOutput,hashType SigHashType) error {
+	if !hashType.valid() {
+		return fmt.Errorf("%w: %#x",ErrInvalidSigHashType,byte(hashType))
+	}
+	hash,err := tx.sigHash(inID,prevOut,hashType)
+	if err != nil {
+		return err
+	}
+	signature,err := privKey.Sign(hash)
+	if err != nil {
+		return err
+	}
+	tx.Vin[inID].Signature = append(signature,byte(hashType))
+	return nil
+}
+//检查输入引用的交易是否都在prevTXs中
+func checkPrevTXs(tx *Transaction,prevTXs map[string]Transaction) error {
+	for _,vin := range tx.Vin {
+		prevTX,ok := prevTXs[hex.EncodeToString(vin.Txid)]
+		if !ok || prevTX.ID == nil {
+			return fmt.Errorf("%w: %x",ErrPrevTxNotFound,vin.Txid)
+		}
+		if vin.Vout < 0 || vin.Vout >= len(prevTX.Vout) {
+			return fmt.Errorf("%w: %x output %d",ErrPrevTxNotFound,vin.Txid,vin.Vout)
+		}
+	}
+	return nil
 }
 
 //验证 交易输入的签名
-func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
+func (tx *Transaction) Verify(prevTXs map[string]Transaction) (bool,error) {
 	if tx.IsCoinbase() {
-		return true
+		return true,nil
 	}
-	for _,vin := range tx.Vin {
-		//遍历输入交易，如果发现输入交易引用的上一交易的ID不存在，则Panic
-		if prevTXs[hex.EncodeToString(vin.Txid)].ID == nil {
-			log.Panic("ERROR: Previous transaction is not correct")
+	//遍历输入交易，如果发现输入交易引用的上一交易不存在，则返回错误
+	if err := checkPrevTXs(tx,prevTXs); err != nil {
+		return false,err
+	}
+	prevOuts := make([]TXOutput,len(tx.Vin))
+	for inID,vin := range tx.Vin {
+		prevOuts[inID] = prevTXs[hex.EncodeToString(vin.Txid)].Vout[vin.Vout]
+	}
+	return tx.VerifyPrevOuts(prevOuts),nil
+}
+
+//验证所有输入的签名，prevOuts[i]为第i个输入引用的输出
+func (tx *Transaction) VerifyPrevOuts(prevOuts []TXOutput) bool {
+	for inID := range tx.Vin {
+		if !tx.VerifyInput(inID,prevOuts[inID]) {
+			return false
 		}
 	}
-	txCopy := tx.TrimmedCopy() //修剪后的副本
-	curve := elliptic.P256() //椭圆曲线实例
+	return true
+}
 
+//把所有输入的签名加入批量验证，prevOuts[i]为第i个输入引用的输出。
+//有签名的格式或者签名哈希类型无效时返回false，这时交易一定无效
+func (tx *Transaction) AddToBatch(bv *wallet.BatchVerifier,prevOuts []TXOutput) bool {
 	for inID,vin := range tx.Vin {
-		prevTX := prevTXs[hex.EncodeToString(vin.Txid)]
-		txCopy.Vin[inID].Signature = nil //双重验证
-		txCopy.Vin[inID].PubKey = prevTX.Vout[vin.Vout].PubkeyHash
-		txCopy.ID = txCopy.Hash()
-		txCopy.Vin[inID].PubKey = nil
-
-		r := big.Int{}
-		s := big.Int{}
-		sigLen := len(vin.Signature)
-		r.SetBytes(vin.Signature[:(sigLen / 2)])
-		s.SetBytes(vin.Signature[(sigLen / 2):])
-
-		x := big.Int{}
-		y := big.Int{}
-		keyLen := len(vin.PubKey)
-		x.SetBytes(vin.PubKey[:(keyLen / 2)])
-		y.SetBytes(vin.PubKey[(keyLen / 2):])
-
-		rawPubKey := ecdsa.PublicKey{curve,&x,&y}
-		if ecdsa.Verify(&rawPubKey,txCopy.ID,&r,&s) == false {
+		sig,hash,err := tx.inputSigHash(inID,prevOuts[inID])
+		if err != nil {
 			return false
 		}
+		bv.Add(vin.PubKey,hash,sig)
 	}
 	return true
 }
 
-//创建在签名中修剪后的交易副本,之所以要这个副本是因为简化了输入交易本身的签名和公钥
-func (tx *Transaction) TrimmedCopy() Transaction {
+//验证第inID个输入的签名，prevOut为该输入引用的输出。
+//签名算法由输入中公钥的类型决定，见wallet.VerifySignature
+func (tx *Transaction) VerifyInput(inID int,prevOut TXOutput) bool {
+	sig,hash,err := tx.inputSigHash(inID,prevOut)
+	return err == nil && wallet.VerifySignature(tx.Vin[inID].PubKey,hash,sig)
+}
+
+//取出第inID个输入的签名(去掉签名哈希类型)，以及按签名哈希类型计算的签名数据。
+//输入中的公钥必须是prevOut锁定的公钥，否则任何人都可以用自己的密钥花费别人的输出
+func (tx *Transaction) inputSigHash(inID int,prevOut TXOutput) ([]byte,[]byte,error) {
+	if !tx.Vin[inID].UsesKey(prevOut.PubkeyHash) {
+		return nil,nil,fmt.Errorf("%w: input %d",ErrWrongKey,inID)
+	}
+	sig,hashType,err := splitSignature(tx.Vin[inID].Signature)
+	if err != nil {
+		return nil,nil,err
+	}
+	hash,err := tx.sigHash(inID,prevOut,hashType)
+	if err != nil {
+		return nil,nil,err
+	}
+	return sig,hash,nil
+}
+
+//创建在签名中修剪后的交易副本,之所以要这个副本是因为简化了输入交易本身的签名和公钥。
+//副本按第inID个输入的签名哈希类型修剪：SigHashNone去掉所有输出，SigHashSingle只保留和inID序号相同的输出
+//(前面的输出用空输出占位)，SigHashAnyOneCanPay只保留第inID个输入
+func (tx *Transaction) TrimmedCopy(inID int,hashType SigHashType) (Transaction,error) {
 	var inputs []TXInput
 	var outputs []TXOutput
 
@@ -236,15 +452,34 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 		outputs = append(outputs,TXOutput{vout.Value,vout.PubkeyHash})
 	}
 
-	txCopy := Transaction{tx.ID,inputs,outputs}
+	switch hashType &^ SigHashAnyOneCanPay {
+	case SigHashNone:
+		outputs = nil
+	case SigHashSingle:
+		if inID >= len(outputs) {
+			return Transaction{},fmt.Errorf("%w: input %d",ErrSigHashSingle,inID)
+		}
+		outputs = outputs[:inID+1]
+		for i := 0; i < inID; i++ {
+			outputs[i] = TXOutput{-1,nil}
+		}
+	}
+	if hashType&SigHashAnyOneCanPay != 0 {
+		inputs = inputs[inID:inID+1]
+	}
+
+	txCopy := Transaction{tx.ID,inputs,outputs,tx.Replaceable}
 
-	return txCopy
+	return txCopy,nil
 }
 
 //把交易转换成我们能正常读的形式
 func (tx Transaction) String() string {
 	var lines []string
 	lines = append(lines, fmt.Sprintf("--Transaction %x:", tx.ID))
+	if tx.Replaceable {
+		lines = append(lines, " Replaceable: true")
+	}
 	for i, input := range tx.Vin {
 		lines = append(lines, fmt.Sprintf(" -Input %d:", i))
 		lines = append(lines, fmt.Sprintf("  TXID: %x", input.Txid))
@@ -272,20 +507,232 @@ func(outs TXOutputs) Serialize() []byte {
 	enc := gob.NewEncoder(&buff)
 	err := enc.Encode(outs)
 	if err != nil {
-		log.Panic(err)
+		panic(err)
 	}
 	return buff.Bytes()
 }
 
 //反序列化
-func DeserializeOutputs(data []byte) TXOutputs {
+func DeserializeOutputs(data []byte) (TXOutputs,error) {
 	var outputs TXOutputs
 
 	dec := gob.NewDecoder(bytes.NewReader(data))
 	err := dec.Decode(&outputs)
+
+	return outputs,err
+}
+
+//交易的JSON编码，字节数组用十六进制表示，地址只用于显示
+type jsonTransaction struct {
+	ID		string			`json:"txid"`
+	Vin		[]jsonInput		`json:"vin"`
+	Vout	[]jsonOutput	`json:"vout"`
+	Replaceable	bool	`json:"replaceable,omitempty"`
+}
+
+type jsonInput struct {
+	Txid		string	`json:"txid"`
+	Vout		int		`json:"vout"`
+	Signature	string	`json:"signature"`
+	PubKey		string	`json:"pubkey"`
+}
+
+type jsonOutput struct {
+	Value		int		`json:"value"`
+	PubKeyHash	string	`json:"pubkeyhash"`
+	Address		string	`json:"address,omitempty"`
+}
+
+func (in jsonInput) decode() (TXInput,error) {
+	txid,err := hex.DecodeString(in.Txid)
+	if err != nil {
+		return TXInput{},err
+	}
+	signature,err := hex.DecodeString(in.Signature)
 	if err != nil {
-		log.Panic(err)
+		return TXInput{},err
 	}
+	pubKey,err := hex.DecodeString(in.PubKey)
+	return TXInput{txid,in.Vout,signature,pubKey},err
+}
+
+func newJSONOutput(out TXOutput) jsonOutput {
+	return jsonOutput{out.Value,hex.EncodeToString(out.PubkeyHash),string(wallet.PubKeyHashToAddress(out.PubkeyHash))}
+}
 
-	return outputs
+func (out jsonOutput) decode() (TXOutput,error) {
+	pubKeyHash,err := hex.DecodeString(out.PubKeyHash)
+	return TXOutput{out.Value,pubKeyHash},err
+}
+
+//把交易编码为JSON
+func (tx Transaction) MarshalJSON() ([]byte,error) {
+	j := jsonTransaction{ID: hex.EncodeToString(tx.ID),Replaceable: tx.Replaceable}
+	for _,vin := range tx.Vin {
+		j.Vin = append(j.Vin,jsonInput{hex.EncodeToString(vin.Txid),vin.Vout,
+			hex.EncodeToString(vin.Signature),hex.EncodeToString(vin.PubKey)})
+	}
+	for _,out := range tx.Vout {
+		j.Vout = append(j.Vout,newJSONOutput(out))
+	}
+	return json.Marshal(j)
+}
+
+//从JSON中解码出交易
+func (tx *Transaction) UnmarshalJSON(data []byte) error {
+	var j jsonTransaction
+	err := json.Unmarshal(data,&j)
+	if err != nil {
+		return err
+	}
+	decoded := Transaction{Replaceable: j.Replaceable}
+	decoded.ID,err = hex.DecodeString(j.ID)
+	if err != nil {
+		return err
+	}
+	for _,in := range j.Vin {
+		vin,err := in.decode()
+		if err != nil {
+			return err
+		}
+		decoded.Vin = append(decoded.Vin,vin)
+	}
+	for _,out := range j.Vout {
+		o,err := out.decode()
+		if err != nil {
+			return err
+		}
+		decoded.Vout = append(decoded.Vout,o)
+	}
+	*tx = decoded
+	return nil
+}
+
+/*
+	离线签名使用的交易：交易本身加上每个输入引用的输出，
+签名时不需要访问区块链，有链的机器和有私钥的机器可以分开
+*/
+type RawTransaction struct {
+	Tx			Transaction
+	PrevOuts	[]TXOutput //和Tx.Vin一一对应
+}
+
+var (
+	//原始交易的编码格式错误，或者引用的输出和输入数量不一致
+	ErrInvalidRawTx = errors.New("raw transaction is not valid")
+	//原始交易还有输入没有有效的签名
+	ErrIncompleteTx = errors.New("raw transaction is not completely signed")
+)
+
+//原始交易的JSON编码
+type jsonRawTransaction struct {
+	Tx			Transaction		`json:"tx"`
+	PrevOuts	[]jsonOutput	`json:"prevouts"`
+}
+
+//把原始交易编码为JSON
+func (raw RawTransaction) MarshalJSON() ([]byte,error) {
+	j := jsonRawTransaction{Tx: raw.Tx}
+	for _,out := range raw.PrevOuts {
+		j.PrevOuts = append(j.PrevOuts,newJSONOutput(out))
+	}
+	return json.Marshal(j)
+}
+
+//从JSON中解码出原始交易
+func (raw *RawTransaction) UnmarshalJSON(data []byte) error {
+	var j jsonRawTransaction
+	err := json.Unmarshal(data,&j)
+	if err != nil {
+		return err
+	}
+	decoded := RawTransaction{Tx: j.Tx}
+	for _,out := range j.PrevOuts {
+		o,err := out.decode()
+		if err != nil {
+			return err
+		}
+		decoded.PrevOuts = append(decoded.PrevOuts,o)
+	}
+	*raw = decoded
+	return nil
+}
+
+//把原始交易编码为十六进制字符串
+func (raw RawTransaction) EncodeHex() string {
+	var buff bytes.Buffer
+	err := gob.NewEncoder(&buff).Encode(raw)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buff.Bytes())
+}
+
+//解码十六进制或者JSON(以'{'开头)编码的原始交易
+func DecodeRawTransaction(encoded string) (*RawTransaction,error) {
+	encoded = strings.TrimSpace(encoded)
+	var raw RawTransaction
+	if strings.HasPrefix(encoded,"{") {
+		err := json.Unmarshal([]byte(encoded),&raw)
+		if err != nil {
+			return nil,fmt.Errorf("%w: %v",ErrInvalidRawTx,err)
+		}
+	} else {
+		data,err := hex.DecodeString(encoded)
+		if err != nil {
+			return nil,fmt.Errorf("%w: %v",ErrInvalidRawTx,err)
+		}
+		err = gob.NewDecoder(bytes.NewReader(data)).Decode(&raw)
+		if err != nil {
+			return nil,fmt.Errorf("%w: %v",ErrInvalidRawTx,err)
+		}
+	}
+	if len(raw.PrevOuts) != len(raw.Tx.Vin) || raw.Tx.IsCoinbase() {
+		return nil,ErrInvalidRawTx
+	}
+	return &raw,nil
+}
+
+//用钱包中的私钥对引用了钱包地址输出的输入签名，hashType为签名覆盖的范围，返回签名的输入数。
+//没有私钥的输入(只读地址或者其他钱包的地址)保持不变，可以交给其他钱包继续签名
+func (raw *RawTransaction) Sign(wallets *wallet.Wallets,hashType SigHashType) (int,error) {
+	if !hashType.valid() {
+		return 0,fmt.Errorf("%w: %#x",ErrInvalidSigHashType,byte(hashType))
+	}
+	keys := make(map[string]*wallet.Wallet)
+	for _,w := range wallets.Wallets {
+		keys[string(wallet.HashPubKey(w.PublicKey))] = w
+	}
+	tx := &raw.Tx
+	//先填上公钥，交易ID不包含公钥和签名，签名前后都不会改变
+	var signers []int
+	for inID,prevOut := range raw.PrevOuts {
+		if w,ok := keys[string(prevOut.PubkeyHash)]; ok {
+			tx.Vin[inID].PubKey = w.PublicKey
+			signers = append(signers,inID)
+		}
+	}
+	tx.ID = tx.TxID()
+
+	for _,inID := range signers {
+		key,err := keys[string(raw.PrevOuts[inID].PubkeyHash)].Key()
+		if err != nil {
+			return 0,err
+		}
+		err = tx.SignInput(inID,key,raw.PrevOuts[inID],hashType)
+		if err != nil {
+			return 0,err
+		}
+	}
+	return len(signers),nil
+}
+
+//判断所有输入是否都有有效的签名，并且公钥属于引用的输出
+func (raw *RawTransaction) Complete() bool {
+	for inID,prevOut := range raw.PrevOuts {
+		if len(raw.Tx.Vin[inID].Signature) == 0 || !raw.Tx.VerifyInput(inID,prevOut) {
+			return false
+		}
+	}
+	return true
 }
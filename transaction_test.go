@@ -0,0 +1,69 @@
+package transaction
+
+import (
+	"testing"
+
+	"go_code/A_golang_blockchain/wallet"
+)
+
+//用攻击者自己的密钥签名，花费锁定在别人地址上的输出
+func stealOutput(t *testing.T, victim, attacker *wallet.Wallet) (*Transaction, TXOutput) {
+	t.Helper()
+	prevOut := *NewTXOutput(50, string(victim.GetAddress()))
+	tx := &Transaction{
+		Vin:  []TXInput{{Txid: make([]byte, 32), Vout: 0, PubKey: attacker.PublicKey}},
+		Vout: []TXOutput{*NewTXOutput(50, string(attacker.GetAddress()))},
+	}
+	tx.ID = tx.TxID()
+	key, err := attacker.Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.SignInput(0, key, prevOut, SigHashAll); err != nil {
+		t.Fatal(err)
+	}
+	return tx, prevOut
+}
+
+func TestVerifyRejectsForeignKey(t *testing.T) {
+	for _, kt := range []wallet.KeyType{wallet.P256, wallet.Secp256k1, wallet.Ed25519, wallet.Schnorr} {
+		victim, err := wallet.NewWalletOfType(kt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		attacker, err := wallet.NewWalletOfType(kt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx, prevOut := stealOutput(t, victim, attacker)
+		prevOuts := []TXOutput{prevOut}
+
+		if tx.VerifyInput(0, prevOut) {
+			t.Errorf("%v: VerifyInput accepts a key that does not own the output", kt)
+		}
+		if tx.VerifyPrevOuts(prevOuts) {
+			t.Errorf("%v: VerifyPrevOuts accepts a key that does not own the output", kt)
+		}
+		bv := wallet.NewBatchVerifier(nil)
+		if tx.AddToBatch(bv, prevOuts) && bv.Verify() {
+			t.Errorf("%v: batch verification accepts a key that does not own the output", kt)
+		}
+		raw := RawTransaction{Tx: *tx, PrevOuts: prevOuts}
+		if raw.Complete() {
+			t.Errorf("%v: raw transaction signed with a foreign key is complete", kt)
+		}
+
+		//同一笔交易花费锁定在攻击者自己地址上的输出时，签名是有效的
+		own := *NewTXOutput(50, string(attacker.GetAddress()))
+		key, err := attacker.Key()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.SignInput(0, key, own, SigHashAll); err != nil {
+			t.Fatal(err)
+		}
+		if !tx.VerifyInput(0, own) {
+			t.Errorf("%v: signature over the attacker's own output does not verify", kt)
+		}
+	}
+}
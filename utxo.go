@@ -1,176 +1,173 @@
 package utxo
 
 import (
+	"bytes"
+	"fmt"
 	"go_code/A_golang_blockchain/transaction"
 	"encoding/hex"
+	"errors"
 	"github.com/boltdb/bolt"
 	"go_code/A_golang_blockchain/blockchain"
-	"go_code/A_golang_blockchain/block"
-	"log"
 )
-const utxoBucket = "chainstate"
+//UTXO集由blockchain在连接区块时维护，这里只负责查询
+const utxoBucket = blockchain.UTXOBucket
+
+//可以花费的输出总额不足
+var ErrInsufficientFunds = errors.New("not enough funds")
 
 //创建一个结构体，代表UTXO集
 type UTXOSet struct {
 	Blockchain *blockchain.Blockchain
 }
 
-//构建UTXO集的索引并存储在数据库的bucket中
-func (u UTXOSet) Reindex() {
-	//调用区块链中的数据库,这里的Db()是格式工厂Blockchain结构体中的字段db
-	db := u.Blockchain.Db()
-	//桶名
-	bucketName := []byte(utxoBucket)
-	//对数据库进行读写操作
-	err := db.Update(func(tx *bolt.Tx) error {
-		err := tx.DeleteBucket(bucketName) //因为我们是要哦重新建一个桶，所以如果原来的数据库中有相同名字的桶，则删除
-		if err != nil && err != bolt.ErrBucketNotFound {
-			log.Panic(err)
-		}
-		//创建新桶
-		_,err = tx.CreateBucket(bucketName)
-		if err != nil {
-			log.Panic(err)
-		}
-		return nil
-	})
-	if err != nil {
-		log.Panic(err)
-	}
-
-	//返回链上所有未花费交易中的交易输出
-	UTXO := u.Blockchain.FindUTXO()
-
-	//把未花费交易中的交易输出集合写入桶中
-	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketName)
+//根据链上的区块重新构建UTXO集的索引并存储在数据库的bucket中
+func (u UTXOSet) Reindex() error {
+	return u.Blockchain.Reindex()
+}
 
-		//写入键值对
-		for txID,outs := range UTXO {
-			key,err := hex.DecodeString(txID)
-			if err != nil {
-				log.Panic(err)
-			}
-			err = b.Put(key,outs.Serialize())
-			if err != nil {
-				log.Panic(err)
-			}
-		}
-		return nil
-	})
-} 
+//地址余额的分类
+type Balance struct {
+	Confirmed	int //确认数不少于minConf并且已经成熟的输出
+	Unconfirmed	int //确认数不足minConf的输出，交易池中的交易不在这里，由mempool计算
+	Immature	int //还没有成熟的coinbase输出
+}
 
-//查询并返回被用于这次花费的输出，找到的输出的总额要刚好大于要花费的输入额
-func (u UTXOSet) FindSpendableOutputs(pubkeyHash []byte,amount int) (int,map[string][]int) {
+//查询并返回被用于这次花费的输出，找到的输出的总额要刚好大于要花费的输入额。
+//只使用确认数不少于minConf、并且可以在下一个区块中花费(coinbase已经成熟)的输出。
+//通过地址索引只访问属于pubkeyHash的输出，返回的输出序号为交易中的原始序号
+func (u UTXOSet) FindSpendableOutputs(pubkeyHash []byte,amount,minConf int) (int,map[string][]int,error) {
 	//存储找到的未花费输出集合
 	unspentOutputs := make(map[string][]int)
 	//记录找到的未花费输出中累加的值
 	accumulated := 0
-	db := u.Blockchain.Db()
 
-	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
-		//声明一个游标，类似于我们之前构造的迭代器
-		c := b.Cursor()
-
-		//用游标来遍历这个桶里的数据,这个桶里装的是链上所有的未花费输出集合
-		for k,v := c.First(); k != nil; k,v =c.Next() {
-			txID := hex.EncodeToString(k)
-			outs := transaction.DeserializeOutputs(v)
-
-			for outIdx,out := range outs.Outputs {
-				if out.IsLockedWithKey(pubkeyHash) && accumulated < amount {
-					accumulated += out.Value
-					unspentOutputs[txID] = append(unspentOutputs[txID],outIdx)
-				}
-			}
-		}
-		return nil
+	err := u.ForEachSpendable(pubkeyHash,minConf,func(txid []byte,vout int,entry blockchain.UTXOEntry) bool {
+		accumulated += entry.Output.Value
+		txID := hex.EncodeToString(txid)
+		unspentOutputs[txID] = append(unspentOutputs[txID],vout)
+		return accumulated < amount
 	})
 	if err != nil {
-		log.Panic(err)
+		return 0,nil,err
 	}
 
-	return accumulated,unspentOutputs
+	return accumulated,unspentOutputs,nil
+}
+
+//按地址索引遍历属于pubKeyHash、确认数不少于minConf并且可以在下一个区块中花费(coinbase已经成熟)的输出，
+//fn返回false时停止遍历
+func (u UTXOSet) ForEachSpendable(pubKeyHash []byte,minConf int,fn func(txid []byte,vout int,entry blockchain.UTXOEntry) bool) error {
+	tipHeight,err := u.Blockchain.Height()
+	if err != nil {
+		return err
+	}
+	return u.forEachOutput(pubKeyHash,func(txid []byte,vout int,entry blockchain.UTXOEntry) bool {
+		if !entry.IsMature(tipHeight+1) || tipHeight-entry.Height+1 < minConf {
+			return true
+		}
+		return fn(txid,vout,entry)
+	})
 }
 
 //查询对应的地址的未花费输出
-func (u UTXOSet) FindUTXO(pubKeyHash []byte) []transaction.TXOutput {
+func (u UTXOSet) FindUTXO(pubKeyHash []byte) ([]transaction.TXOutput,error) {
 	var UTXOs []transaction.TXOutput
-	db := u.Blockchain.Db()
 
-	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
-		c := b.Cursor()
+	err := u.forEachOutput(pubKeyHash,func(txid []byte,vout int,entry blockchain.UTXOEntry) bool {
+		UTXOs = append(UTXOs,entry.Output)
+		return true
+	})
+	if err != nil {
+		return nil,err
+	}
+	return UTXOs,nil
+}
 
-		for k,v := c.First();k != nil;k,v = c.Next() {
-			outs := transaction.DeserializeOutputs(v)
+//按确认数和成熟度分类统计地址的余额
+func (u UTXOSet) Balance(pubKeyHash []byte,minConf int) (Balance,error) {
+	var balance Balance
+	tipHeight,err := u.Blockchain.Height()
+	if err != nil {
+		return balance,err
+	}
 
-			for _,out := range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) {
-					UTXOs = append(UTXOs,out)
-				}
-			}
+	err = u.forEachOutput(pubKeyHash,func(txid []byte,vout int,entry blockchain.UTXOEntry) bool {
+		switch {
+		case !entry.IsMature(tipHeight+1):
+			balance.Immature += entry.Output.Value
+		case tipHeight-entry.Height+1 < minConf:
+			balance.Unconfirmed += entry.Output.Value
+		default:
+			balance.Confirmed += entry.Output.Value
 		}
-		return nil
+		return true
 	})
-	if err != nil {
-		log.Panic(err)
-	}
-	return UTXOs
+	return balance,err
 }
 
-//当区块链中的区块增加后，要同步更新UTXO集,这里引入的区块为新加入的区块。
-func (u UTXOSet) Update(block *block.Block) {
+//按地址索引遍历属于pubKeyHash的未花费输出，fn返回false时停止遍历
+func (u UTXOSet) forEachOutput(pubKeyHash []byte,fn func(txid []byte,vout int,entry blockchain.UTXOEntry) bool) error {
 	db := u.Blockchain.Db()
 
-	err := db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
+	return db.View(func(tx *bolt.Tx) error {
+		utxos := tx.Bucket([]byte(utxoBucket))
+		//声明一个游标，从公钥哈希前缀开始遍历地址索引
+		c := tx.Bucket([]byte(blockchain.UTXOAddrBucket)).Cursor()
 
-		for _,tx := range block.Transactions {
-			if tx.IsCoinbase() == false {
-				for _,vin := range tx.Vin {
-					//实例化结构体TXOutputs
-					updatedOuts := transaction.TXOutputs{}
-					outsBytes := b.Get(vin.Txid)
-					outs := transaction.DeserializeOutputs(outsBytes)
-
-					for outIdx,out := range outs.Outputs {
-						if outIdx != vin.Vout {
-							updatedOuts.Outputs = append(updatedOuts.Outputs,out)
-						}
-					}
-					if len(updatedOuts.Outputs) == 0 {
-						err := b.Delete(vin.Txid)
-						if err != nil  {
-							log.Panic(err)
-						}
-					}else{
-						err := b.Put(vin.Txid,updatedOuts.Serialize())
-						if err != nil {
-							log.Panic(err)
-						}
-					}
-				}
-			}
-			newOutputs := transaction.TXOutputs{}
-			for _,out := range tx.Vout {
-				newOutputs.Outputs = append(newOutputs.Outputs,out)
+		for k,_ := c.Seek(pubKeyHash); k != nil && bytes.HasPrefix(k,pubKeyHash); k,_ = c.Next() {
+			key := k[len(pubKeyHash):]
+			data := utxos.Get(key)
+			if data == nil {
+				return fmt.Errorf("address index refers to missing output %x",key)
 			}
-
-			err := b.Put(tx.ID,newOutputs.Serialize())
+			entry,err := blockchain.DeserializeUTXOEntry(data)
 			if err != nil {
-				log.Panic(err)
+				return err
+			}
+			txid,vout := blockchain.ParseOutpointKey(key)
+			if !fn(txid,vout,entry) {
+				return nil
 			}
 		}
 		return nil
 	})
+}
+
+//返回交易txid的第vout个输出在UTXO集中的条目，输出不在UTXO集中时返回nil
+func (u UTXOSet) GetEntry(txid []byte,vout int) (*blockchain.UTXOEntry,error) {
+	var entry *blockchain.UTXOEntry
+	db := u.Blockchain.Db()
+
+	err := db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(utxoBucket)).Get(blockchain.OutpointKey(txid,vout))
+		if data == nil {
+			return nil
+		}
+		e,err := blockchain.DeserializeUTXOEntry(data)
+		entry = &e
+		return err
+	})
 	if err != nil {
-		log.Panic(err)
+		return nil,err
 	}
+	return entry,nil
 }
-//返回UTXO集中的交易数
-func (u UTXOSet) CountTransactions() int {
+
+//判断交易txid的第vout个输出是否还在UTXO集中
+func (u UTXOSet) HasOutput(txid []byte,vout int) (bool,error) {
+	found := false
+	db := u.Blockchain.Db()
+
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		found = b.Get(blockchain.OutpointKey(txid,vout)) != nil
+		return nil
+	})
+	return found,err
+}
+
+//返回UTXO集中还有未花费输出的交易数
+func (u UTXOSet) CountTransactions() (int,error) {
 	db := u.Blockchain.Db() 
 	counter := 0
 
@@ -178,13 +175,16 @@ func (u UTXOSet) CountTransactions() int {
 		b := tx.Bucket([]byte(utxoBucket))
 		c := b.Cursor()
 
+		//同一交易的输出在桶中是相邻的
+		var lastTxid []byte
 		for k,_ := c.First(); k != nil; k,_ = c.Next() {
-			counter++
+			txid,_ := blockchain.ParseOutpointKey(k)
+			if !bytes.Equal(txid,lastTxid) {
+				counter++
+				lastTxid = txid
+			}
 		}
 		return nil
 	})
-	if err != nil {
-		log.Panic(err)
-	}
-	return counter
+	return counter,err
 }
@@ -1,57 +1,513 @@
 package wallet
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/sha256"
 	"crypto/elliptic"
 	"crypto/ecdsa"
 	"crypto/rand"
-	"log"
+	"crypto/hmac"
+	"errors"
 	"os"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
 	"encoding/gob"
+	"encoding/binary"
+	"crypto/ed25519"
 	"golang.org/x/crypto/ripemd160"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	secp256k1ecdsa "github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
 	"go_code/A_golang_blockchain/base58"
+	"go_code/A_golang_blockchain/chaincfg"
+	"go_code/A_golang_blockchain/schnorr"
 
 )
-const version = byte(0x00)
-const walletFile = "wallet.dat"
+//地址版本号由当前网络参数chaincfg.ActiveNetParams决定，钱包文件路径由调用者传入
 const addressChecksumLen = 4 //对校验位一般取4位
 
-//创建一个钱包结构体,钱包里面只装公钥和私钥
+var (
+	//钱包集合中没有该地址
+	ErrWalletNotFound = errors.New("wallet not found for address")
+	//地址格式错误、校验位错误或者不属于当前网络
+	ErrInvalidAddress = errors.New("address is not valid")
+	//只读地址没有私钥，不能用来签名
+	ErrWatchOnly = errors.New("address is watch-only, private key is not available")
+	//钱包中已经有该地址
+	ErrAddressExists = errors.New("address is already in the wallet")
+	//公钥不是曲线上的点
+	ErrInvalidPubKey = errors.New("public key is not valid")
+	//WIF格式错误、校验位错误、不属于当前网络或者不是有效的私钥
+	ErrInvalidPrivateKey = errors.New("private key is not valid")
+	//私钥对应的地址和给出的地址不一致
+	ErrAddressMismatch = errors.New("private key does not match address")
+	//不支持的密钥类型
+	ErrUnknownKeyType = errors.New("unknown key type")
+)
+
+/*
+	密钥类型：钱包支持P-256 ECDSA(默认)、secp256k1 ECDSA、Ed25519和secp256k1 Schnorr(BIP 340)四种签名算法。
+公钥的编码中带有密钥类型：P-256的公钥没有类型标记(和之前的地址兼容)，其他类型的公钥在前面加上一个字节的类型标记。
+地址只是编码后公钥的哈希，从地址看不出密钥类型，花费时输入中给出公钥才能知道，
+给出的公钥换一种类型标记哈希就不同，所以一个地址只能用一种类型的密钥花费
+*/
+type KeyType byte
+
+const (
+	P256 KeyType = iota
+	Secp256k1
+	Ed25519
+	Schnorr
+)
+
+//公钥编码中的类型标记
+const (
+	secp256k1PubKeyTag = 0xb1 //0xb1 + 33字节的压缩公钥
+	ed25519PubKeyTag = 0xed //0xed + 32字节的公钥
+	schnorrPubKeyTag = 0x5c //0x5c + 32字节的x坐标
+)
+
+//密钥类型的名称
+func (t KeyType) String() string {
+	switch t {
+	case P256:
+		return "p256"
+	case Secp256k1:
+		return "secp256k1"
+	case Ed25519:
+		return "ed25519"
+	case Schnorr:
+		return "schnorr"
+	}
+	return fmt.Sprintf("KeyType(%d)",byte(t))
+}
+
+//通过名称得到密钥类型
+func ParseKeyType(name string) (KeyType,error) {
+	for _,t := range []KeyType{P256,Secp256k1,Ed25519,Schnorr} {
+		if strings.EqualFold(name,t.String()) {
+			return t,nil
+		}
+	}
+	return 0,fmt.Errorf("%w: %s",ErrUnknownKeyType,name)
+}
+
+//签名用的私钥，每种密钥类型有自己的实现
+type PrivateKey interface {
+	Type() KeyType
+	//带类型标记的公钥编码
+	PubKey() []byte
+	//对哈希签名，签名都是确定性的
+	Sign(hash []byte) ([]byte,error)
+	//32字节的私钥，用于保存和WIF
+	Serialize() []byte
+}
+
+//随机生成一个私钥
+func GeneratePrivateKey(t KeyType) (PrivateKey,error) {
+	switch t {
+	case P256:
+		key,err := ecdsa.GenerateKey(elliptic.P256(),rand.Reader)
+		if err != nil {
+			return nil,err
+		}
+		return p256Key{key},nil
+	case Secp256k1,Schnorr:
+		key,err := secp256k1.GeneratePrivateKey()
+		if err != nil {
+			return nil,err
+		}
+		if t == Schnorr {
+			return schnorrKey{key},nil
+		}
+		return secp256k1Key{key},nil
+	case Ed25519:
+		_,key,err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil,err
+		}
+		return ed25519Key{key},nil
+	}
+	return nil,ErrUnknownKeyType
+}
+
+//由32字节的私钥恢复出私钥，不在有效范围内时返回ErrInvalidPrivateKey
+func ParsePrivateKey(t KeyType,secret []byte) (PrivateKey,error) {
+	if len(secret) != 32 {
+		return nil,ErrInvalidPrivateKey
+	}
+	switch t {
+	case P256:
+		curve := elliptic.P256()
+		d := new(big.Int).SetBytes(secret)
+		if d.Sign() == 0 || d.Cmp(curve.Params().N) >= 0 {
+			return nil,ErrInvalidPrivateKey
+		}
+		key := &ecdsa.PrivateKey{D: d}
+		key.PublicKey.Curve = curve
+		key.PublicKey.X,key.PublicKey.Y = curve.ScalarBaseMult(secret)
+		return p256Key{key},nil
+	case Secp256k1,Schnorr:
+		var d secp256k1.ModNScalar
+		if overflow := d.SetByteSlice(secret); overflow || d.IsZero() {
+			return nil,ErrInvalidPrivateKey
+		}
+		if t == Schnorr {
+			return schnorrKey{secp256k1.NewPrivateKey(&d)},nil
+		}
+		return secp256k1Key{secp256k1.NewPrivateKey(&d)},nil
+	case Ed25519:
+		return ed25519Key{ed25519.NewKeyFromSeed(secret)},nil
+	}
+	return nil,ErrUnknownKeyType
+}
+
+//P-256 ECDSA私钥，签名格式见SignHash
+type p256Key struct {
+	key *ecdsa.PrivateKey
+}
+
+func (k p256Key) Type() KeyType { return P256 }
+func (k p256Key) PubKey() []byte { return CompressPubKey(&k.key.PublicKey) }
+func (k p256Key) Sign(hash []byte) ([]byte,error) { return SignHash(k.key,hash) }
+func (k p256Key) Serialize() []byte { return padTo32(k.key.D.Bytes()) }
+
+//secp256k1 ECDSA私钥，签名为RFC 6979确定性的 r || s，s取较小的值
+type secp256k1Key struct {
+	key *secp256k1.PrivateKey
+}
+
+func (k secp256k1Key) Type() KeyType { return Secp256k1 }
+
+func (k secp256k1Key) PubKey() []byte {
+	return append([]byte{secp256k1PubKeyTag},k.key.PubKey().SerializeCompressed()...)
+}
+
+func (k secp256k1Key) Sign(hash []byte) ([]byte,error) {
+	sig := secp256k1ecdsa.Sign(k.key,hash)
+	r,s := sig.R(),sig.S()
+	rBytes,sBytes := r.Bytes(),s.Bytes()
+	return append(rBytes[:],sBytes[:]...),nil
+}
+
+func (k secp256k1Key) Serialize() []byte {
+	secret := k.key.Key.Bytes()
+	return secret[:]
+}
+
+//Ed25519私钥，Serialize返回32字节的种子
+type ed25519Key struct {
+	key ed25519.PrivateKey
+}
+
+func (k ed25519Key) Type() KeyType { return Ed25519 }
+
+func (k ed25519Key) PubKey() []byte {
+	return append([]byte{ed25519PubKeyTag},k.key.Public().(ed25519.PublicKey)...)
+}
+
+func (k ed25519Key) Sign(hash []byte) ([]byte,error) { return ed25519.Sign(k.key,hash),nil }
+func (k ed25519Key) Serialize() []byte { return k.key.Seed() }
+
+//secp256k1 Schnorr私钥，和secp256k1Key使用同样的私钥，签名格式见schnorr.Sign
+type schnorrKey struct {
+	key *secp256k1.PrivateKey
+}
+
+func (k schnorrKey) Type() KeyType { return Schnorr }
+
+func (k schnorrKey) PubKey() []byte {
+	return append([]byte{schnorrPubKeyTag},schnorr.SerializePubKey(k.key.PubKey())...)
+}
+
+func (k schnorrKey) Sign(hash []byte) ([]byte,error) { return schnorr.Sign(k.key,hash) }
+
+func (k schnorrKey) Serialize() []byte {
+	secret := k.key.Key.Bytes()
+	return secret[:]
+}
+
+//由公钥的编码得到密钥类型，没有类型标记的是P-256公钥
+func PubKeyType(pubKey []byte) KeyType {
+	switch {
+	case len(pubKey) == 1+CompressedPubKeyLen && pubKey[0] == secp256k1PubKeyTag:
+		return Secp256k1
+	case len(pubKey) == 1+ed25519.PublicKeySize && pubKey[0] == ed25519PubKeyTag:
+		return Ed25519
+	case len(pubKey) == 1+schnorr.PubKeyLen && pubKey[0] == schnorrPubKeyTag:
+		return Schnorr
+	}
+	return P256
+}
+
+//检查公钥是否为有效的编码
+func ValidatePubKey(pubKey []byte) error {
+	switch PubKeyType(pubKey) {
+	case Secp256k1:
+		if _,err := secp256k1.ParsePubKey(pubKey[1:]); err != nil {
+			return ErrInvalidPubKey
+		}
+		return nil
+	case Ed25519:
+		return nil
+	case Schnorr:
+		if schnorr.ParsePubKey(pubKey[1:]) != nil {
+			return ErrInvalidPubKey
+		}
+		return nil
+	}
+	_,err := ParsePubKey(pubKey)
+	return err
+}
+
+//按公钥的类型验证签名，签名必须是Sign生成的格式
+func VerifySignature(pubKey,hash,sig []byte) bool {
+	switch PubKeyType(pubKey) {
+	case Secp256k1:
+		key,err := secp256k1.ParsePubKey(pubKey[1:])
+		if err != nil || len(sig) != SignatureLen {
+			return false
+		}
+		var r,s secp256k1.ModNScalar
+		if r.SetByteSlice(sig[:32]) || s.SetByteSlice(sig[32:]) || r.IsZero() || s.IsZero() || s.IsOverHalfOrder() {
+			return false
+		}
+		return secp256k1ecdsa.NewSignature(&r,&s).Verify(hash,key)
+	case Ed25519:
+		//ed25519.Verify会拒绝不规范的S，签名不能被改写
+		return len(sig) == ed25519.SignatureSize && ed25519.Verify(pubKey[1:],hash,sig)
+	case Schnorr:
+		return schnorr.Verify(pubKey[1:],hash,sig)
+	}
+	key,err := ParsePubKey(pubKey)
+	return err == nil && VerifyHash(key,hash,sig)
+}
+
+//批量验证签名：Schnorr签名先攒起来，在Verify时一起验证(见schnorr.BatchVerifier)，
+//其他类型的签名不能合并，加入时立即验证。
+//给出签名缓存时，缓存中已有的签名直接跳过，验证通过的签名加入缓存。
+//BatchVerifier不能在多个goroutine中同时使用，SigCache可以
+type BatchVerifier struct {
+	schnorr	*schnorr.BatchVerifier
+	cache	*SigCache
+	pending	[][32]byte //批量验证通过后再加入缓存的Schnorr签名
+	failed	bool
+}
+
+//cache可以为nil
+func NewBatchVerifier(cache *SigCache) *BatchVerifier {
+	return &BatchVerifier{schnorr: schnorr.NewBatchVerifier(),cache: cache}
+}
+
+//加入一个待验证的签名，参数和VerifySignature相同
+func (bv *BatchVerifier) Add(pubKey,hash,sig []byte) {
+	if bv.failed {
+		return
+	}
+	var key [32]byte
+	if bv.cache != nil {
+		key = sigCacheKey(pubKey,hash,sig)
+		if bv.cache.contains(key) {
+			return
+		}
+	}
+	if PubKeyType(pubKey) == Schnorr {
+		bv.schnorr.Add(pubKey[1:],hash,sig)
+		if bv.cache != nil {
+			bv.pending = append(bv.pending,key)
+		}
+		return
+	}
+	bv.failed = !VerifySignature(pubKey,hash,sig)
+	if !bv.failed && bv.cache != nil {
+		bv.cache.add(key)
+	}
+}
+
+//加入的签名全部有效时返回true
+func (bv *BatchVerifier) Verify() bool {
+	if bv.failed || !bv.schnorr.Verify() {
+		return false
+	}
+	for _,key := range bv.pending {
+		bv.cache.add(key)
+	}
+	bv.pending = nil
+	return true
+}
+
+//签名缓存默认的条目数
+const DefaultSigCacheSize = 100000
+
+/*
+	签名缓存：记录验证通过的(公钥, 签名数据, 签名)，例如交易放入交易池时验证过的签名，
+交易被打包进区块时不需要再验证一次。签名数据是交易的签名哈希，包括了引用的输出，
+所以同样的三元组总是有效的。缓存满了之后随机删除一个条目，可以在多个goroutine中同时使用
+*/
+type SigCache struct {
+	mu		sync.RWMutex
+	entries	map[[32]byte]struct{}
+	maxEntries	int
+}
+
+func NewSigCache(maxEntries int) *SigCache {
+	return &SigCache{entries: make(map[[32]byte]struct{}),maxEntries: maxEntries}
+}
+
+//签名是否已经验证过
+func (c *SigCache) Contains(pubKey,hash,sig []byte) bool {
+	return c.contains(sigCacheKey(pubKey,hash,sig))
+}
+
+//记录一个验证通过的签名
+func (c *SigCache) Add(pubKey,hash,sig []byte) {
+	c.add(sigCacheKey(pubKey,hash,sig))
+}
+
+//缓存中的条目数
+func (c *SigCache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.entries)
+}
+
+func (c *SigCache) contains(key [32]byte) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_,ok := c.entries[key]
+	return ok
+}
+
+func (c *SigCache) add(key [32]byte) {
+	if c.maxEntries <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _,ok := c.entries[key]; ok {
+		return
+	}
+	//map的遍历顺序是随机的，删除遍历到的第一个条目
+	for len(c.entries) >= c.maxEntries {
+		for k := range c.entries {
+			delete(c.entries,k)
+			break
+		}
+	}
+	c.entries[key] = struct{}{}
+}
+
+//缓存的键：各部分带上长度，避免不同的划分得到相同的键
+func sigCacheKey(pubKey,hash,sig []byte) [32]byte {
+	h := sha256.New()
+	for _,part := range [][]byte{pubKey,hash,sig} {
+		var n [4]byte
+		binary.BigEndian.PutUint32(n[:],uint32(len(part)))
+		h.Write(n[:])
+		h.Write(part)
+	}
+	var key [32]byte
+	h.Sum(key[:0])
+	return key
+}
+
+//钱包里面装着一个私钥和它的公钥
 type Wallet struct {
-	PrivateKey 		ecdsa.PrivateKey
-	PublicKey 		[]byte
+	PrivateKey	ecdsa.PrivateKey //旧版本钱包文件中的P-256私钥，加载时转换为Type和Secret
+	PublicKey	[]byte
+	Type		KeyType
+	Secret		[]byte //32字节的私钥，见PrivateKey.Serialize
 }
 
-//实例化一个钱包
-func NewWallet() *Wallet {
-	//生成秘钥对
-	private , public := newKeyPair()
-	wallet := &Wallet{private,public}
-	return wallet
+//实例化一个P-256钱包
+func NewWallet() (*Wallet,error) {
+	return NewWalletOfType(P256)
 }
-//生成密钥对函数
-func newKeyPair() (ecdsa.PrivateKey,[]byte) {
-	//返回一个实现了P-256的曲线
-	curve := elliptic.P256()
-	//通过椭圆曲线 随机生成一个私钥
-	private ,err := ecdsa.GenerateKey(curve,rand.Reader)
+
+//实例化一个指定密钥类型的钱包
+func NewWalletOfType(t KeyType) (*Wallet,error) {
+	key,err := GeneratePrivateKey(t)
 	if err != nil {
-		log.Panic(err)
+		return nil,err
 	}
-	pubKey := append(private.PublicKey.X.Bytes(),private.PublicKey.Y.Bytes()...)
+	return &Wallet{PublicKey: key.PubKey(),Type: t,Secret: key.Serialize()},nil
+}
+
+//返回钱包的私钥
+func (w Wallet) Key() (PrivateKey,error) {
+	return ParsePrivateKey(w.Type,w.Secret)
+}
+
+//公钥的编码长度
+const (
+	CompressedPubKeyLen = 33 //0x02或0x03(Y的奇偶) + 32字节的X
+	UncompressedPubKeyLen = 65 //0x04 + 32字节的X + 32字节的Y
+)
+
+//公钥的压缩编码，新钱包都使用这种编码
+func CompressPubKey(pubKey *ecdsa.PublicKey) []byte {
+	return elliptic.MarshalCompressed(pubKey.Curve,pubKey.X,pubKey.Y)
+}
+
+//旧版本钱包的公钥编码：X.Bytes() || Y.Bytes()，没有补0，长度不固定。
+//链上已经有支付给这种公钥哈希的输出，所以仍然可以用来签名和验证
+func legacyPubKey(pubKey *ecdsa.PublicKey) []byte {
+	return append(pubKey.X.Bytes(),pubKey.Y.Bytes()...)
+}
+
+//判断公钥是否为旧版本钱包的P-256公钥编码
+func IsLegacyPubKey(pubKey []byte) bool {
+	return PubKeyType(pubKey) == P256 &&
+		len(pubKey) != CompressedPubKeyLen && len(pubKey) != UncompressedPubKeyLen
+}
 
-	return *private,pubKey
+//解析压缩(33字节)、非压缩(65字节)或者旧版本编码的P-256公钥，公钥必须是曲线上的点
+func ParsePubKey(pubKey []byte) (*ecdsa.PublicKey,error) {
+	if PubKeyType(pubKey) != P256 {
+		return nil,ErrInvalidPubKey
+	}
+	curve := elliptic.P256()
+	var x,y *big.Int
+	switch {
+	case len(pubKey) == CompressedPubKeyLen && (pubKey[0] == 0x02 || pubKey[0] == 0x03):
+		x,y = elliptic.UnmarshalCompressed(curve,pubKey)
+	case len(pubKey) == UncompressedPubKeyLen && pubKey[0] == 0x04:
+		x,y = elliptic.Unmarshal(curve,pubKey)
+	case IsLegacyPubKey(pubKey) && len(pubKey) <= 64:
+		//X和Y都没有补0，逐个尝试分界的位置，只有一个位置能得到曲线上的点
+		for xLen := len(pubKey)-32; xLen <= 32 && xLen < len(pubKey); xLen++ {
+			if xLen < 1 {
+				continue
+			}
+			lx := new(big.Int).SetBytes(pubKey[:xLen])
+			ly := new(big.Int).SetBytes(pubKey[xLen:])
+			if curve.IsOnCurve(lx,ly) {
+				x,y = lx,ly
+				break
+			}
+		}
+	}
+	if x == nil {
+		return nil,ErrInvalidPubKey
+	}
+	return &ecdsa.PublicKey{Curve: curve,X: x,Y: y},nil
 }
 
 //生成一个地址
 func (w Wallet) GetAddress() []byte {
 	//调用公钥哈希函数，实现RIPEMD160(SHA256(Public Key))
-	pubKeyHash := HashPubKey(w.PublicKey)
+	return PubKeyHashToAddress(HashPubKey(w.PublicKey))
+}
+
+//由公钥哈希得到当前网络的地址，AddressPubKeyHash的逆操作
+func PubKeyHashToAddress(pubKeyHash []byte) []byte {
 	//存储version和公钥哈希的切片
-	versionedPayload := append([]byte{version},pubKeyHash...)
+	versionedPayload := append([]byte{chaincfg.ActiveNetParams.AddressVersion},pubKeyHash...)
 	//调用checksum函数，对上面的切片进行双重哈希后，取出哈希后的切片的前面部分作为检验位的值
 	checksum := checksum(versionedPayload)
 	//把校验位加到上面切片后面
@@ -62,16 +518,192 @@ func (w Wallet) GetAddress() []byte {
 	return address
 }
  
+//WIF中私钥后面的标志，表示密钥类型和公钥的编码。
+//没有标志的WIF是旧版本编码公钥的P-256私钥
+const (
+	wifFlagP256 = 0x01
+	wifFlagSecp256k1 = 0x02
+	wifFlagEd25519 = 0x03
+	wifFlagSchnorr = 0x04
+)
+
+//把私钥编码为WIF格式：(一个字节的version) + (32字节的私钥) + [标志] + (Checksum)，再经过base58编码
+func (w Wallet) EncodePrivateKey() string {
+	payload := make([]byte,1,1+32+1)
+	payload[0] = chaincfg.ActiveNetParams.PrivateKeyVersion
+	payload = append(payload,w.Secret...)
+	switch {
+	case w.Type == Secp256k1:
+		payload = append(payload,wifFlagSecp256k1)
+	case w.Type == Ed25519:
+		payload = append(payload,wifFlagEd25519)
+	case w.Type == Schnorr:
+		payload = append(payload,wifFlagSchnorr)
+	case !IsLegacyPubKey(w.PublicKey):
+		payload = append(payload,wifFlagP256)
+	}
+	return string(base58.Base58Encode(append(payload,checksum(payload)...)))
+}
+
+//从WIF格式的私钥恢复出钱包，公钥由私钥计算得到，类型和编码由标志决定
+func DecodePrivateKey(wif string) (*Wallet,error) {
+	decoded := base58.Base58Decode([]byte(wif))
+	if len(decoded) != 1+32+addressChecksumLen && len(decoded) != 1+32+1+addressChecksumLen {
+		return nil,ErrInvalidPrivateKey
+	}
+	payload := decoded[:len(decoded)-addressChecksumLen]
+	if !bytes.Equal(checksum(payload),decoded[len(payload):]) ||
+		payload[0] != chaincfg.ActiveNetParams.PrivateKeyVersion {
+		return nil,ErrInvalidPrivateKey
+	}
+	t := P256
+	if len(payload) == 1+32+1 {
+		switch payload[1+32] {
+		case wifFlagP256:
+		case wifFlagSecp256k1:
+			t = Secp256k1
+		case wifFlagEd25519:
+			t = Ed25519
+		case wifFlagSchnorr:
+			t = Schnorr
+		default:
+			return nil,ErrInvalidPrivateKey
+		}
+	}
+	secret := payload[1:1+32]
+	key,err := ParsePrivateKey(t,secret)
+	if err != nil {
+		return nil,err
+	}
+	w := &Wallet{PublicKey: key.PubKey(),Type: t,Secret: key.Serialize()}
+	if len(payload) == 1+32 {
+		w.PublicKey = legacyPubKey(&key.(p256Key).key.PublicKey)
+	}
+	return w,nil
+}
+
+//签名的长度：r和s各32字节，不足32字节的在前面补0
+const SignatureLen = 64
+
+//对哈希签名，返回固定长度的 r || s。
+//随机数k按RFC 6979由私钥和哈希确定，同一私钥对同一哈希的签名总是相同；
+//s取s和N-s中较小的一个(low-S)，避免签名被改写成另一个有效的签名
+func SignHash(privKey *ecdsa.PrivateKey,hash []byte) ([]byte,error) {
+	params := privKey.Curve.Params()
+	n := params.N
+	if privKey.D == nil || privKey.D.Sign() <= 0 || privKey.D.Cmp(n) >= 0 {
+		return nil,ErrInvalidPrivateKey
+	}
+	e := bitsToInt(hash,n)
+	nextK := nonceRFC6979(privKey.D,hash,n)
+	for {
+		k := nextK()
+		x,_ := privKey.Curve.ScalarBaseMult(padTo32(k.Bytes()))
+		r := new(big.Int).Mod(x,n)
+		if r.Sign() == 0 {
+			continue
+		}
+		//s = k^-1 * (e + r*d) mod N
+		s := new(big.Int).Mul(r,privKey.D)
+		s.Add(s,e)
+		s.Mul(s,new(big.Int).ModInverse(k,n))
+		s.Mod(s,n)
+		if s.Sign() == 0 {
+			continue
+		}
+		if s.Cmp(new(big.Int).Rsh(n,1)) > 0 {
+			s.Sub(n,s)
+		}
+		return append(padTo32(r.Bytes()),padTo32(s.Bytes())...),nil
+	}
+}
+
+//验证SignHash格式的签名：长度必须为SignatureLen，并且s必须是较小的值
+func VerifyHash(pubKey *ecdsa.PublicKey,hash,sig []byte) bool {
+	if len(sig) != SignatureLen {
+		return false
+	}
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	if s.Cmp(new(big.Int).Rsh(pubKey.Curve.Params().N,1)) > 0 {
+		return false
+	}
+	return ecdsa.Verify(pubKey,hash,r,s)
+}
+
+//RFC 6979 3.2：返回依次生成候选随机数k的函数，k在[1,N-1]之间
+func nonceRFC6979(d *big.Int,hash []byte,n *big.Int) func() *big.Int {
+	qlen := (n.BitLen()+7)/8
+	x := make([]byte,qlen)
+	d.FillBytes(x)
+	h1 := make([]byte,qlen)
+	new(big.Int).Mod(bitsToInt(hash,n),n).FillBytes(h1)
+
+	mac := func(key []byte,data ...[]byte) []byte {
+		h := hmac.New(sha256.New,key)
+		for _,b := range data {
+			h.Write(b)
+		}
+		return h.Sum(nil)
+	}
+	v := bytes.Repeat([]byte{0x01},sha256.Size)
+	k := make([]byte,sha256.Size)
+	k = mac(k,v,[]byte{0x00},x,h1)
+	v = mac(k,v)
+	k = mac(k,v,[]byte{0x01},x,h1)
+	v = mac(k,v)
+
+	first := true
+	return func() *big.Int {
+		for {
+			//上一个候选值不可用时更新K和V
+			if !first {
+				k = mac(k,v,[]byte{0x00})
+				v = mac(k,v)
+			}
+			first = false
+			var t []byte
+			for len(t) < qlen {
+				v = mac(k,v)
+				t = append(t,v...)
+			}
+			candidate := bitsToInt(t,n)
+			if candidate.Sign() > 0 && candidate.Cmp(n) < 0 {
+				return candidate
+			}
+		}
+	}
+}
+
+//RFC 6979 2.3.2 bits2int：取最左边和N相同位数的比特
+func bitsToInt(b []byte,n *big.Int) *big.Int {
+	orderBits := n.BitLen()
+	orderBytes := (orderBits+7)/8
+	if len(b) > orderBytes {
+		b = b[:orderBytes]
+	}
+	v := new(big.Int).SetBytes(b)
+	if excess := len(b)*8-orderBits; excess > 0 {
+		v.Rsh(v,uint(excess))
+	}
+	return v
+}
+
+//在前面补0到32字节
+func padTo32(b []byte) []byte {
+	if len(b) >= 32 {
+		return b
+	}
+	return append(make([]byte,32-len(b)),b...)
+}
+
 //公钥哈希函数，实现RIPEMD160(SHA256(Public Key))
 func HashPubKey(pubKey []byte) []byte {
 	//先hash公钥
 	publicSHA256 := sha256.Sum256(pubKey)
 	//对公钥哈希值做 ripemd160运算
 	RIPEMD160Hasher := ripemd160.New()
-	_,err := RIPEMD160Hasher.Write(publicSHA256[:])
-	if err != nil {
-		log.Panic(err)
-	}
+	RIPEMD160Hasher.Write(publicSHA256[:]) //hash.Hash的Write不会返回错误
 	publicRIPEMD160 := RIPEMD160Hasher.Sum(nil)
 
 	return publicRIPEMD160
@@ -86,42 +718,237 @@ func checksum(payload []byte) []byte {
 	return secondSHA[:addressChecksumLen]  
 }
 
-//判断输入的地址是否有效,主要是检查后面的校验位是否正确
+//从地址中解析出公钥哈希，地址组成形式为：(一个字节的version) + (Public key hash) + (Checksum)
+func AddressPubKeyHash(address string) []byte {
+	pubKeyHash := base58.Base58Decode([]byte(address))
+	return pubKeyHash[1:len(pubKeyHash)-addressChecksumLen]
+}
+
+//判断输入的地址是否有效,主要是检查后面的校验位是否正确，以及版本号是否属于当前网络
 func ValidateAddress(address string) bool {
 	//解码base58编码过的地址
 	pubKeyHash := base58.Base58Decode([]byte(address))
+	//公钥哈希是RIPEMD160的结果，长度固定
+	if len(pubKeyHash) != 1+ripemd160.Size+addressChecksumLen {
+		return false
+	}
 	//拆分pubKeyHash,pubKeyHash组成形式为：(一个字节的version) + (Public key hash) + (Checksum) 
 	actualChecksum := pubKeyHash[len(pubKeyHash)-addressChecksumLen:]
 	version := pubKeyHash[0]
 	pubKeyHash = pubKeyHash[1:len(pubKeyHash)-addressChecksumLen]
 	targetChecksum := checksum(append([]byte{version},pubKeyHash...))
+	//其他网络的地址不能在当前网络使用
+	if version != chaincfg.ActiveNetParams.AddressVersion {
+		return false
+	}
 	//比较拆分出的校验位与计算出的目标校验位是否相等
 	return bytes.Compare(actualChecksum,targetChecksum) == 0
 }
 
+//只读(watch-only)地址：只有公钥哈希，可能还有公钥，没有私钥。
+//可以查询余额和交易记录，但是不能用来签名
+type WatchOnly struct {
+	PubKeyHash	[]byte
+	PublicKey	[]byte //通过importaddress导入时为空
+}
+
 //创建一个钱包集合的结构体
 type Wallets struct {
-	Wallets map[string]*Wallet
+	Wallets		map[string]*Wallet
+	WatchOnly	map[string]*WatchOnly //只读地址
 }
 
-// 实例化一个钱包集合，
-func NewWallets() (*Wallets, error) {
+// 实例化一个钱包集合，并从walletFile中加载已有的钱包，文件不存在时返回空的集合
+func NewWallets(walletFile string) (*Wallets, error) {
 	wallets := Wallets{}
 	wallets.Wallets = make(map[string]*Wallet)
-	err := wallets.LoadFromFile()
+	wallets.WatchOnly = make(map[string]*WatchOnly)
+	err := wallets.LoadFromFile(walletFile)
+	if os.IsNotExist(err) {
+		return &wallets, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	//旧版本的钱包文件在第一次打开时升级
+	if _, changed := wallets.Migrate(); changed {
+		err = wallets.SaveToFile(walletFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &wallets, nil
+}
 
-	return &wallets, err
+// 将 P-256 Wallet 添加进 Wallets
+func (ws *Wallets) CreateWallet() (string, error) {
+	return ws.CreateWalletOfType(P256)
 }
 
-// 将 Wallet 添加进 Wallets
-func (ws *Wallets) CreateWallet() string {
-	wallet := NewWallet()
+// 将指定密钥类型的 Wallet 添加进 Wallets
+func (ws *Wallets) CreateWalletOfType(t KeyType) (string, error) {
+	wallet, err := NewWalletOfType(t)
+	if err != nil {
+		return "", err
+	}
 	address := fmt.Sprintf("%s", wallet.GetAddress())
 	ws.Wallets[address] = wallet
-	return address
+	return address, nil
 }
 
-// 得到存储在wallets里的地址
+// 导入WIF格式的私钥，返回私钥对应的地址。
+// 已经作为只读地址导入的地址变为可以花费的地址
+func (ws *Wallets) ImportPrivateKey(wif string) (string, error) {
+	wallet, err := DecodePrivateKey(wif)
+	if err != nil {
+		return "", err
+	}
+	address := string(wallet.GetAddress())
+	if _, ok := ws.Wallets[address]; ok {
+		return address, fmt.Errorf("%w: %s", ErrAddressExists, address)
+	}
+	delete(ws.WatchOnly, address)
+	ws.Wallets[address] = wallet
+	return address, nil
+}
+
+// 导出地址的WIF格式私钥
+func (ws Wallets) DumpPrivateKey(address string) (string, error) {
+	wallet, err := ws.GetWallet(address)
+	if err != nil {
+		return "", err
+	}
+	return wallet.EncodePrivateKey(), nil
+}
+
+// 把钱包中所有私钥按地址顺序写入w，每行为 "WIF 地址"，以#开头的行为注释。
+// 只读地址没有私钥，不会被导出
+func (ws Wallets) Dump(w io.Writer) error {
+	addresses := ws.GetAddresses()
+	sort.Strings(addresses)
+	_, err := fmt.Fprintf(w, "# wallet dump, network %s\n# WIF ADDRESS\n", chaincfg.ActiveNetParams.Name)
+	if err != nil {
+		return err
+	}
+	for _, address := range addresses {
+		_, err = fmt.Fprintf(w, "%s %s\n", ws.Wallets[address].EncodePrivateKey(), address)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 从Dump导出的内容中导入私钥，每个私钥对应的地址必须和同一行中的地址一致，
+// 钱包中已有的地址会被跳过，返回导入的地址。出错时不会修改钱包
+func (ws *Wallets) ImportDump(r io.Reader) ([]string, error) {
+	imported := make(map[string]*Wallet)
+	var addresses []string
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: %w", line, ErrInvalidPrivateKey)
+		}
+		wallet, err := DecodePrivateKey(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		address := string(wallet.GetAddress())
+		if address != fields[1] {
+			return nil, fmt.Errorf("line %d: %w: %s", line, ErrAddressMismatch, fields[1])
+		}
+		if _, ok := ws.Wallets[address]; ok {
+			continue
+		}
+		if _, ok := imported[address]; !ok {
+			addresses = append(addresses, address)
+		}
+		imported[address] = wallet
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for address, wallet := range imported {
+		delete(ws.WatchOnly, address)
+		ws.Wallets[address] = wallet
+	}
+	return addresses, nil
+}
+
+// 导入一个只读地址
+func (ws *Wallets) ImportAddress(address string) error {
+	if !ValidateAddress(address) {
+		return ErrInvalidAddress
+	}
+	return ws.addWatchOnly(address, &WatchOnly{AddressPubKeyHash(address), nil})
+}
+
+// 导入一个公钥作为只读地址，返回公钥对应的地址
+func (ws *Wallets) ImportPubKey(pubKey []byte) (string, error) {
+	if err := ValidatePubKey(pubKey); err != nil {
+		return "", err
+	}
+	pubKeyHash := HashPubKey(pubKey)
+	address := string(PubKeyHashToAddress(pubKeyHash))
+	return address, ws.addWatchOnly(address, &WatchOnly{pubKeyHash, pubKey})
+}
+
+// 加入只读地址，已经有私钥或者已经导入过的地址返回ErrAddressExists
+func (ws *Wallets) addWatchOnly(address string, w *WatchOnly) error {
+	if _, ok := ws.Wallets[address]; ok {
+		return fmt.Errorf("%w: %s", ErrAddressExists, address)
+	}
+	if _, ok := ws.WatchOnly[address]; ok {
+		return fmt.Errorf("%w: %s", ErrAddressExists, address)
+	}
+	if ws.WatchOnly == nil {
+		ws.WatchOnly = make(map[string]*WatchOnly)
+	}
+	ws.WatchOnly[address] = w
+	return nil
+}
+
+// 升级旧版本的钱包，返回新增的地址，changed表示钱包是否有变化需要保存：
+// 旧版本保存在PrivateKey中的私钥转换为Type和Secret；
+// 为每个旧版本编码公钥的私钥加上压缩公钥的地址，旧地址保留下来，支付给旧地址的输出仍然可以花费
+func (ws *Wallets) Migrate() (added []string, changed bool) {
+	upgraded := make(map[string]*Wallet)
+	for _, w := range ws.Wallets {
+		if w.Secret == nil && w.PrivateKey.D != nil {
+			w.Type = P256
+			w.Secret = padTo32(w.PrivateKey.D.Bytes())
+			w.PrivateKey = ecdsa.PrivateKey{}
+			changed = true
+		}
+		if !IsLegacyPubKey(w.PublicKey) {
+			continue
+		}
+		key, err := w.Key()
+		if err != nil {
+			continue
+		}
+		compressed := &Wallet{PublicKey: key.PubKey(), Type: P256, Secret: w.Secret}
+		address := string(compressed.GetAddress())
+		if _, ok := ws.Wallets[address]; !ok {
+			upgraded[address] = compressed
+		}
+	}
+	for address, w := range upgraded {
+		ws.Wallets[address] = w
+		delete(ws.WatchOnly, address)
+		added = append(added, address)
+	}
+	sort.Strings(added)
+	return added, changed || len(added) > 0
+}
+
+// 得到存储在wallets里的地址，不包括只读地址
 func (ws *Wallets) GetAddresses() []string {
 	var addresses []string
 	for address := range ws.Wallets {
@@ -129,42 +956,84 @@ func (ws *Wallets) GetAddresses() []string {
 	}
 	return addresses
 }
-// 通过地址返回出钱包
-func (ws Wallets) GetWallet(address string) Wallet {
-	return *ws.Wallets[address]
+
+// 得到钱包中的只读地址
+func (ws *Wallets) GetWatchOnlyAddresses() []string {
+	var addresses []string
+	for address := range ws.WatchOnly {
+		addresses = append(addresses, address)
+	}
+	return addresses
+}
+
+// 返回钱包中所有地址(包括只读地址)的公钥哈希
+func (ws *Wallets) PubKeyHashes() [][]byte {
+	var hashes [][]byte
+	for _, w := range ws.Wallets {
+		hashes = append(hashes, HashPubKey(w.PublicKey))
+	}
+	for _, w := range ws.WatchOnly {
+		hashes = append(hashes, w.PubKeyHash)
+	}
+	return hashes
+}
+
+// 判断地址是否为只读地址
+func (ws Wallets) IsWatchOnly(address string) bool {
+	_, ok := ws.WatchOnly[address]
+	return ok
+}
+
+// 通过地址返回出钱包，没有该地址时返回ErrWalletNotFound，只读地址返回ErrWatchOnly
+func (ws Wallets) GetWallet(address string) (Wallet, error) {
+	wallet, ok := ws.Wallets[address]
+	if !ok {
+		if ws.IsWatchOnly(address) {
+			return Wallet{}, fmt.Errorf("%w: %s", ErrWatchOnly, address)
+		}
+		return Wallet{}, fmt.Errorf("%w: %s", ErrWalletNotFound, address)
+	}
+	return *wallet, nil
 }
 
 // 从文件中加载钱包s
-func (ws *Wallets) LoadFromFile() error {
+func (ws *Wallets) LoadFromFile(walletFile string) error {
 	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
 		return err
 	}
 	fileContent, err := ioutil.ReadFile(walletFile)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 	var wallets Wallets
 	gob.Register(elliptic.P256())
 	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
 	err = decoder.Decode(&wallets)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 	ws.Wallets = wallets.Wallets
+	//旧的钱包文件中没有只读地址
+	ws.WatchOnly = wallets.WatchOnly
+	if ws.WatchOnly == nil {
+		ws.WatchOnly = make(map[string]*WatchOnly)
+	}
 	return nil
 }
 
 // 将钱包s保存到文件
-func (ws Wallets) SaveToFile() {
+func (ws Wallets) SaveToFile(walletFile string) error {
 	var content bytes.Buffer
 	gob.Register(elliptic.P256())
 	encoder := gob.NewEncoder(&content)
 	err := encoder.Encode(ws)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
-	err = ioutil.WriteFile(walletFile, content.Bytes(), 0644)
-	if err != nil {
-		log.Panic(err)
+	//钱包文件中有私钥，只允许所有者读写；旧版本创建的0644文件在写入之前先收紧权限
+	err = os.Chmod(walletFile, 0600)
+	if err != nil && !os.IsNotExist(err) {
+		return err
 	}
+	return ioutil.WriteFile(walletFile, content.Bytes(), 0600)
 }
@@ -0,0 +1,192 @@
+package wallet
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
+
+//钱包文件只允许所有者读写，已经存在的文件也会收紧权限
+func TestSaveToFilePermissions(t *testing.T) {
+	ws := &Wallets{Wallets: map[string]*Wallet{}}
+	if _, err := ws.CreateWallet(); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	fresh := filepath.Join(dir, "wallet.dat")
+	old := filepath.Join(dir, "old_wallet.dat")
+	if err := ioutil.WriteFile(old, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{fresh, old} {
+		if err := ws.SaveToFile(file); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != 0600 {
+			t.Errorf("%s: mode %o, want 600", filepath.Base(file), perm)
+		}
+	}
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+//RFC 6979 A.2.5中P-256、SHA-256的测试向量，s换成low-S之后的值
+func TestSignHashRFC6979(t *testing.T) {
+	curve := elliptic.P256()
+	d := new(big.Int).SetBytes(mustHex(t, "C9AFA9D845BA75166B5C215767B1D6934E50C3DB36E89B127B8A622B120F6721"))
+	key := &ecdsa.PrivateKey{D: d}
+	key.Curve = curve
+	key.X, key.Y = curve.ScalarBaseMult(d.Bytes())
+	tests := []struct {
+		msg  string
+		r, s string
+	}{
+		{"sample", "EFD48B2AACB6A8FD1140DD9CD45E81D69D2C877B56AAF991C34D0EA84EAF3716", "F7CB1C942D657C41D436C7A1B6E29F65F3E900DBB9AFF4064DC4AB2F843ACDA8"},
+		{"test", "F1ABB023518351CD71D881567B1EA663ED3EFCF6C5132B354F28D3B0B7D38367", "019F4113742A2B14BD25926B49C649155F267E60D3814B4C0CC84250E46F0083"},
+	}
+	n := curve.Params().N
+	for _, tt := range tests {
+		hash := sha256.Sum256([]byte(tt.msg))
+		sig, err := SignHash(key, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := new(big.Int).SetBytes(mustHex(t, tt.s))
+		if s.Cmp(new(big.Int).Rsh(n, 1)) > 0 {
+			s.Sub(n, s)
+		}
+		want := append(mustHex(t, tt.r), padTo32(s.Bytes())...)
+		if !bytes.Equal(sig, want) {
+			t.Errorf("%s: signature %x, want %x", tt.msg, sig, want)
+		}
+	}
+}
+
+//每种密钥类型的签名都是确定性的：同一私钥对同一哈希的签名相同，不同的哈希得到不同的签名
+func TestSignDeterministic(t *testing.T) {
+	for _, kt := range []KeyType{P256, Secp256k1, Ed25519, Schnorr} {
+		for i := 0; i < 8; i++ {
+			key, err := GeneratePrivateKey(kt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seen := make(map[string]bool)
+			for j := 0; j < 8; j++ {
+				hash := sha256.Sum256([]byte(fmt.Sprintf("message %d", j)))
+				sig1, err := key.Sign(hash[:])
+				if err != nil {
+					t.Fatal(err)
+				}
+				sig2, err := key.Sign(hash[:])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(sig1, sig2) {
+					t.Fatalf("%v key %d message %d: signatures differ", kt, i, j)
+				}
+				if len(sig1) != SignatureLen {
+					t.Fatalf("%v key %d message %d: signature length %d, want %d", kt, i, j, len(sig1), SignatureLen)
+				}
+				if !VerifySignature(key.PubKey(), hash[:], sig1) {
+					t.Fatalf("%v key %d message %d: signature does not verify", kt, i, j)
+				}
+				if seen[string(sig1)] {
+					t.Fatalf("%v key %d: same signature for different messages", kt, i)
+				}
+				seen[string(sig1)] = true
+			}
+		}
+	}
+}
+
+//ECDSA签名的s总是较小的值，把s换成N-s得到的签名虽然满足ECDSA方程，也会被拒绝
+func TestSignLowS(t *testing.T) {
+	orders := map[KeyType]*big.Int{
+		P256:      elliptic.P256().Params().N,
+		Secp256k1: secp256k1.S256().N,
+	}
+	for kt, n := range orders {
+		half := new(big.Int).Rsh(n, 1)
+		for i := 0; i < 32; i++ {
+			key, err := GeneratePrivateKey(kt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hash := sha256.Sum256([]byte(fmt.Sprintf("low-s %d", i)))
+			sig, err := key.Sign(hash[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := new(big.Int).SetBytes(sig[32:])
+			if s.Cmp(half) > 0 {
+				t.Fatalf("%v: signature %d has high S", kt, i)
+			}
+			highS := append(append([]byte{}, sig[:32]...), padTo32(new(big.Int).Sub(n, s).Bytes())...)
+			if VerifySignature(key.PubKey(), hash[:], highS) {
+				t.Fatalf("%v: high-S signature %d verifies", kt, i)
+			}
+			if kt == P256 {
+				pub, err := ParsePubKey(key.PubKey())
+				if err != nil {
+					t.Fatal(err)
+				}
+				r := new(big.Int).SetBytes(sig[:32])
+				if !ecdsa.Verify(pub, hash[:], r, new(big.Int).Sub(n, s)) {
+					t.Fatalf("high-S signature %d is not a valid ECDSA signature", i)
+				}
+			}
+		}
+	}
+}
+
+//签名必须正好是SignatureLen字节
+func TestVerifyRejectsWrongLength(t *testing.T) {
+	hash := sha256.Sum256([]byte("length"))
+	for _, kt := range []KeyType{P256, Secp256k1, Ed25519, Schnorr} {
+		key, err := GeneratePrivateKey(kt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := key.Sign(hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		tests := []struct {
+			name string
+			sig  []byte
+		}{
+			{"empty", nil},
+			{"truncated", sig[:SignatureLen-1]},
+			{"half", sig[:32]},
+			{"trailing byte", append(append([]byte{}, sig...), 0)},
+			{"leading zero", append([]byte{0}, sig...)},
+			{"doubled", append(append([]byte{}, sig...), sig...)},
+		}
+		for _, tt := range tests {
+			if VerifySignature(key.PubKey(), hash[:], tt.sig) {
+				t.Errorf("%v: %s signature (%d bytes) verifies", kt, tt.name, len(tt.sig))
+			}
+		}
+	}
+}